@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// backupDetails is what the API shows about a single backup
+type backupDetails struct {
+	backupEntry
+	// missing for backups created by older versions
+	Manifest *manifestSummary `json:"manifest,omitempty"`
+}
+
+type manifestSummary struct {
+	Deduplicated     bool  `json:"deduplicated"`
+	ServerVersion    int   `json:"server_version"`
+	StartTime        int64 `json:"start_time"`
+	EndTime          int64 `json:"end_time"`
+	Files            int   `json:"files"`
+	Size             int64 `json:"size"`
+	UploadedBytes    int64 `json:"uploaded_bytes"`
+	Failures         int   `json:"failures"`
+	ChecksumFailures int   `json:"checksum_failures"`
+}
+
+// registerAPI adds the endpoints of the control API of the daemon to mux; all of them require the --api-token to be
+// given as a bearer token
+//
+//	GET  /backups         list all backups (as list-backups does)
+//	POST /backups         create a backup as soon as possible
+//	GET  /backups/<name>  show a backup
+//	POST /expire          expire old backups as soon as possible
+//	GET  /jobs            show the scheduled jobs, when they last ran, when they run next, and the progress of the
+//	                      one running
+func (a *app) registerAPI(mux *http.ServeMux, state *daemonState) {
+	mux.HandleFunc("/backups", a.authorized(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			backups, err := a.getBackups()
+			if err != nil {
+				a.writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			a.writeJSON(w, http.StatusOK, backups)
+		case http.MethodPost:
+			a.triggerJob(w, state, "backup")
+		default:
+			a.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+	}))
+
+	mux.HandleFunc("/backups/", a.authorized(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			a.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		a.showBackup(w, strings.TrimPrefix(r.URL.Path, "/backups/"))
+	}))
+
+	mux.HandleFunc("/expire", a.authorized(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			a.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		a.triggerJob(w, state, "retention")
+	}))
+
+	mux.HandleFunc("/jobs", a.authorized(func(w http.ResponseWriter, r *http.Request) {
+		body, err := json.Marshal(state.snapshot())
+		if err != nil {
+			a.writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+}
+
+// authorized wraps handler so that it's only called for requests bearing the API token
+func (a *app) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(*a.apiToken)) != 1 {
+			a.writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func (a *app) showBackup(w http.ResponseWriter, backupName string) {
+	if err := validateBackupName([]string{backupName}); err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, err := a.storage.GetString(a.ctx, backupName+"/"); err != nil {
+		a.writeError(w, http.StatusNotFound, errors.New("backup not found: "+backupName))
+		return
+	}
+
+	details := backupDetails{backupEntry: a.getBackup(backupName, a.getLatest())}
+	if m, err := a.getManifest(backupName); err == nil {
+		details.Manifest = &manifestSummary{
+			Deduplicated:     m.Deduplicated,
+			ServerVersion:    m.ServerVersion,
+			StartTime:        m.StartTime,
+			EndTime:          m.EndTime,
+			Files:            len(m.Files),
+			Size:             m.size(),
+			UploadedBytes:    m.UploadedBytes,
+			Failures:         m.Failures,
+			ChecksumFailures: m.checksumFailures(),
+		}
+	}
+
+	a.writeJSON(w, http.StatusOK, details)
+}
+
+// triggerJob makes the job with the given name run as soon as the daemon is done with whatever it's doing
+func (a *app) triggerJob(w http.ResponseWriter, state *daemonState, name string) {
+	job, err := state.trigger(name)
+	if err == errJobNotFound {
+		a.writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		a.writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	a.logger.Info("Job triggered through the API", zap.String("job", name))
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	a.writeJSON(w, http.StatusAccepted, job)
+}
+
+func (a *app) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (a *app) writeError(w http.ResponseWriter, status int, err error) {
+	a.writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -34,7 +34,7 @@ func (a *app) archiveWAL() int {
 		return 1
 	}
 	// upload the compressed file
-	err = a.storage.Put(key, compressedWal, 0)
+	err = a.storage.Put(a.ctx, key, compressedWal, 0)
 	// regardless of whether or not the upload operation was successful, remove the compressed file
 	util.MustRemoveFile(compressedWal, a.logger)
 	// return non-zero on error
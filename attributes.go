@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// permissions of restored files and directories whose mode is unknown, i.e., from older backups
+	defaultFileMode      = 0600
+	defaultDirectoryMode = 0700
+)
+
+// fileAttributes are the permissions and ownership of a file, and the target of symlinks. Older backups did not
+// record them, in which case Mode is 0.
+type fileAttributes struct {
+	Mode uint32 `json:"mode,omitempty"`
+	UID  int    `json:"uid,omitempty"`
+	GID  int    `json:"gid,omitempty"`
+	// target of the symlink at the file's path, if it is one (other than a tablespace)
+	Link string `json:"link,omitempty"`
+}
+
+// readFileAttributes returns the attributes of the file at path (pgFile relative to the data directory), as given
+// by info (which follows symlinks)
+func readFileAttributes(pgFile string, path string, info os.FileInfo) (fileAttributes, error) {
+	attrs := fileAttributes{Mode: uint32(info.Mode().Perm())}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		attrs.UID = int(st.Uid)
+		attrs.GID = int(st.Gid)
+	}
+
+	lst, err := os.Lstat(path)
+	if err != nil {
+		return attrs, err
+	}
+	// tablespaces are restored from tablespace_map
+	if lst.Mode()&os.ModeSymlink != 0 && !isTablespaceLink(pgFile, lst) {
+		attrs.Link, err = os.Readlink(path)
+	}
+
+	return attrs, err
+}
+
+// the user and group to own restored files
+type fileOwner struct {
+	uid int
+	gid int
+}
+
+// parseOwner parses the value of --owner, user[:group], where both may be names or numeric IDs; without a group,
+// the user's primary group is used
+func parseOwner(owner string) (*fileOwner, error) {
+	parts := strings.SplitN(owner, ":", 2)
+
+	u, err := user.Lookup(parts[0])
+	if err != nil {
+		u, err = user.LookupId(parts[0])
+	}
+	if err != nil {
+		return nil, errors.New("unknown user: " + parts[0])
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parts) == 2 {
+		g, err := user.LookupGroup(parts[1])
+		if err != nil {
+			g, err = user.LookupGroupId(parts[1])
+		}
+		if err != nil {
+			return nil, errors.New("unknown group: " + parts[1])
+		}
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &fileOwner{uid: uid, gid: gid}, nil
+}
+
+// applyAttributes sets the permissions and ownership of the restored file or directory at path. Files are owned by
+// the user given with --owner or, if running as root, by the original owner; otherwise by whoever runs the restore.
+func (a *app) applyAttributes(path string, entry manifestEntry) error {
+	mode := os.FileMode(entry.Mode)
+	if mode == 0 {
+		mode = defaultFileMode
+		if entry.Directory {
+			mode = defaultDirectoryMode
+		}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+
+	switch {
+	case a.restoreOwner != nil:
+		return os.Lchown(path, a.restoreOwner.uid, a.restoreOwner.gid)
+	case entry.Mode != 0 && os.Geteuid() == 0:
+		return os.Lchown(path, entry.UID, entry.GID)
+	}
+
+	return nil
+}
+
+// restoreLink recreates the symlink at dst recorded in entry. Links to directories (e.g., pg_wal on a separate
+// volume) are always restored, creating the target directory if needed. Links to files are only restored if the
+// target exists on this host; otherwise false is returned so that the contents of the file are restored in place of
+// the link.
+func (a *app) restoreLink(dst string, entry manifestEntry) (bool, error) {
+	target := entry.Link
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(dst), target)
+	}
+
+	if entry.Directory {
+		if err := os.MkdirAll(target, defaultDirectoryMode); err != nil {
+			return false, err
+		}
+		if err := a.applyAttributes(target, entry); err != nil {
+			return false, err
+		}
+	} else if _, err := os.Stat(target); err != nil {
+		a.logger.Warn(
+			"Symlink target does not exist, restoring the file instead",
+			zap.String("path", entry.Path),
+			zap.String("target", entry.Link))
+		return false, nil
+	}
+
+	// replace whatever is there, unless it's the same link; directories with contents are not removed
+	if current, err := os.Readlink(dst); err == nil && current == entry.Link {
+		return true, nil
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		if err := os.Remove(dst); err != nil {
+			return false, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), defaultDirectoryMode); err != nil {
+		return false, err
+	}
+
+	return true, os.Symlink(entry.Link, dst)
+}
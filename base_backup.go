@@ -0,0 +1,400 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/thumbtack/pgCarpenter/util"
+	"go.uber.org/zap"
+)
+
+// a file or directory received from the server, waiting to be uploaded
+type stagedFile struct {
+	// path relative to the data directory
+	path string
+	// temporary copy of the file (empty for directories)
+	localPath string
+	size      int64
+	mtime     int64
+	directory bool
+	attrs     fileAttributes
+}
+
+// streamBaseBackup takes a backup over the streaming replication protocol: it issues BASE_BACKUP and splits the tar
+// archives the server sends into one object per file, using the same layout as a backup of the data directory.
+// Unlike the latter, it does not require access to the data directory. It returns the number of files uploaded.
+func (a *app) streamBaseBackup() (int, error) {
+	a.logger.Info("Starting backup over the replication protocol", zap.String("name", *a.backupName))
+
+	connStr, err := a.connInfo()
+	if err != nil {
+		return 0, err
+	}
+
+	d := time.Now().Add(time.Duration(*a.statementTimeout) * time.Second)
+	ctx, cancel := context.WithDeadline(a.ctx, d)
+	conn, err := pgconn.Connect(ctx, connStr+" replication='true'")
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close(context.Background())
+
+	a.serverVersion, err = parseServerVersion(conn.ParameterStatus("server_version"))
+	if err != nil {
+		return 0, err
+	}
+	a.logger.Debug("Connected to PostgreSQL", zap.Int("server_version_num", a.serverVersion))
+
+	// the files we upload are temporary copies of what the server sent, not the data directory
+	a.readLimiter = nil
+
+	// the server applies its own exclusion rules, only the user's are left for us
+	a.exclusions = newExclusionRules("", a.serverVersion, false, *a.excludePatterns)
+
+	// the server tells us the size of the data directory along with the list of tablespaces
+	stopProgress := a.startProgress("Backup", 0, 0)
+	defer stopProgress()
+
+	// spawn a pool of workers
+	a.logger.Info("Spawning workers", zap.Int("number", *a.nWorkers))
+	filesC := make(chan stagedFile)
+	wg := &sync.WaitGroup{}
+	wg.Add(*a.nWorkers)
+	for i := 0; i < *a.nWorkers; i++ {
+		go a.stagedBackupWorker(filesC, wg)
+	}
+
+	items, err := a.receiveBaseBackup(conn, filesC)
+
+	a.logger.Info("Waiting for all workers to finish")
+	close(filesC)
+	wg.Wait()
+
+	return items, err
+}
+
+// the BASE_BACKUP command; its syntax changed in PG 15. PROGRESS makes the server estimate the size of each tablespace,
+// which is reported along with them, at the cost of an extra pass over the data directory on its side.
+func (a *app) baseBackupCommand() string {
+	if a.serverVersion >= 150000 {
+		checkpoint := "spread"
+		if *a.backupCheckpoint {
+			checkpoint = "fast"
+		}
+		return fmt.Sprintf(
+			"BASE_BACKUP (LABEL %s, CHECKPOINT '%s', WAIT %t, TABLESPACE_MAP, PROGRESS, MANIFEST 'no', "+
+				"VERIFY_CHECKSUMS %t)",
+			quoteLiteral(*a.backupName),
+			checkpoint,
+			!*a.noWaitForArchive,
+			!*a.noVerifyChecksums)
+	}
+
+	cmd := fmt.Sprintf("BASE_BACKUP LABEL %s PROGRESS TABLESPACE_MAP", quoteLiteral(*a.backupName))
+	if *a.backupCheckpoint {
+		cmd += " FAST"
+	}
+	if *a.noWaitForArchive {
+		cmd += " NOWAIT"
+	}
+	// the server verifies page checksums itself since PG 11
+	if *a.noVerifyChecksums && a.serverVersion >= 110000 {
+		cmd += " NOVERIFY_CHECKSUMS"
+	}
+
+	return cmd
+}
+
+// quoteLiteral quotes s as a string literal of a replication command, which, like standard SQL strings, escapes
+// quotes by doubling them
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// receiveBaseBackup issues BASE_BACKUP and processes the server's response until it's done
+//
+// up to PG 14 the server sends a result set with the start position, another with one row per tablespace (the main
+// data directory last, each with its estimated size in kB), a COPY stream with a tar archive for each tablespace, in
+// the same order, and a final result set with the end position. From PG 15 on, all archives are sent in a single COPY
+// stream in which each message is tagged: 'n' starts a new archive, 'd' is archive data, 'p' reports progress, and
+// 'm' starts the backup manifest.
+func (a *app) receiveBaseBackup(conn *pgconn.PgConn, filesC chan<- stagedFile) (int, error) {
+	ctx := a.ctx
+	conn.Frontend().Send(&pgproto3.Query{String: a.baseBackupCommand()})
+	if err := conn.Frontend().Flush(); err != nil {
+		return 0, err
+	}
+
+	items := 0
+	results := 0
+	// tablespace OIDs (empty for the main data directory) in the order their archives are sent, up to PG 14
+	tablespaces := make([]string, 0)
+	archives := 0
+	totalBytes := int64(0)
+	var archive *archiveReader
+	// finish the archive being received, if any, and wait until all of its files are staged
+	closeArchive := func() error {
+		if archive == nil {
+			return nil
+		}
+		n, err := archive.close()
+		items += n
+		archive = nil
+		return err
+	}
+
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			closeArchive()
+			return items, err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.DataRow:
+			if len(msg.Values) == 0 {
+				closeArchive()
+				return items, errors.New("unexpected empty row in response to BASE_BACKUP")
+			}
+			switch {
+			case results == 0:
+				a.startLSN = string(msg.Values[0])
+				a.logger.Info("Backup started", zap.String("lsn", a.startLSN))
+			case results == 1:
+				tablespaces = append(tablespaces, string(msg.Values[0]))
+				if len(msg.Values) > 2 {
+					if kB, err := strconv.ParseInt(string(msg.Values[2]), 10, 64); err == nil {
+						totalBytes += kB * 1024
+					}
+				}
+			default:
+				a.stopLSN = string(msg.Values[0])
+				a.logger.Info("Backup stopped", zap.String("lsn", a.stopLSN))
+			}
+		case *pgproto3.CommandComplete:
+			results++
+			if results == 2 {
+				a.progress.setTotals(0, totalBytes)
+			}
+		case *pgproto3.CopyOutResponse:
+			if a.serverVersion < 150000 {
+				if archives >= len(tablespaces) {
+					return items, errors.New("received more archives than tablespaces")
+				}
+				archive = a.openArchive(tablespaces[archives], filesC)
+				archives++
+			}
+		case *pgproto3.CopyData:
+			if a.serverVersion < 150000 {
+				if err := archive.write(msg.Data); err != nil {
+					closeArchive()
+					return items, err
+				}
+				continue
+			}
+			if len(msg.Data) == 0 {
+				continue
+			}
+			switch msg.Data[0] {
+			case 'n':
+				if err := closeArchive(); err != nil {
+					return items, err
+				}
+				// the archive name (base.tar or <OID>.tar) followed by the tablespace location
+				name := string(bytes.SplitN(msg.Data[1:], []byte{0}, 2)[0])
+				oid := strings.TrimSuffix(name, ".tar")
+				if oid == "base" {
+					oid = ""
+				}
+				archive = a.openArchive(oid, filesC)
+			case 'd':
+				if archive == nil {
+					return items, errors.New("received archive data before the archive started")
+				}
+				if err := archive.write(msg.Data[1:]); err != nil {
+					closeArchive()
+					return items, err
+				}
+			case 'm':
+				// we don't ask for a manifest, we build our own
+				if err := closeArchive(); err != nil {
+					return items, err
+				}
+			}
+		case *pgproto3.CopyDone:
+			if err := closeArchive(); err != nil {
+				return items, err
+			}
+		case *pgproto3.ErrorResponse:
+			closeArchive()
+			return items, pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.ReadyForQuery:
+			return items, closeArchive()
+		}
+	}
+}
+
+// archiveReader extracts the files of one tar archive, as it's being received, to temporary files
+type archiveReader struct {
+	writer *io.PipeWriter
+	done   chan struct{}
+	items  int
+	err    error
+}
+
+// openArchive starts extracting a new archive; the files of tablespace archives are placed under pg_tblspc/<OID>
+func (a *app) openArchive(oid string, filesC chan<- stagedFile) *archiveReader {
+	prefix := ""
+	if oid != "" {
+		prefix = filepath.Join(tablespacesDirectory, oid)
+	}
+	a.logger.Info("Receiving archive", zap.String("tablespace", prefix))
+
+	r, w := io.Pipe()
+	archive := &archiveReader{writer: w, done: make(chan struct{})}
+	go func() {
+		defer close(archive.done)
+		archive.items, archive.err = a.extractArchive(r, prefix, filesC)
+		if archive.err == nil {
+			// the server may pad the archive beyond the end-of-archive marker
+			_, archive.err = io.Copy(ioutil.Discard, r)
+		}
+		// make sure the sender is not left blocked if we stopped early
+		r.CloseWithError(archive.err)
+	}()
+
+	return archive
+}
+
+func (r *archiveReader) write(data []byte) error {
+	_, err := r.writer.Write(data)
+
+	return err
+}
+
+// close signals the end of the archive, waits for all its files to be staged, and returns how many there were
+func (r *archiveReader) close() (int, error) {
+	r.writer.Close()
+	<-r.done
+
+	return r.items, r.err
+}
+
+// extractArchive reads a tar archive from r, copies each regular file to a temporary file, and puts it in filesC
+// for a worker to upload
+func (a *app) extractArchive(r io.Reader, prefix string, filesC chan<- stagedFile) (int, error) {
+	items := 0
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return items, err
+		}
+
+		file := filepath.Join(prefix, strings.TrimPrefix(filepath.Clean(hdr.Name), "./"))
+		if file == "." {
+			continue
+		}
+		if a.exclusions.matchesUserPattern(file) {
+			a.logger.Debug("Ignoring file", zap.String("path", file))
+			continue
+		}
+
+		item := stagedFile{
+			path:  file,
+			mtime: hdr.ModTime.Unix(),
+			attrs: fileAttributes{Mode: uint32(os.FileMode(hdr.Mode).Perm()), UID: hdr.Uid, GID: hdr.Gid},
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			item.directory = true
+		case tar.TypeSymlink:
+			// symlinks are either tablespaces (restored from tablespace_map) or directories like pg_wal that
+			// live elsewhere; either way a directory is what we need
+			item.directory = true
+			if !strings.HasPrefix(file, tablespacesDirectory+"/") {
+				item.attrs.Link = hdr.Linkname
+			}
+		case tar.TypeReg:
+			out, err := ioutil.TempFile(*a.tmpDirectory, "pgCarpenter.")
+			if err != nil {
+				return items, err
+			}
+			item.localPath = out.Name()
+			item.size, err = io.Copy(out, tr)
+			if err == nil {
+				err = out.Close()
+			} else {
+				out.Close()
+			}
+			if err != nil {
+				os.Remove(item.localPath)
+				return items, err
+			}
+		default:
+			continue
+		}
+
+		a.logger.Debug("Adding file", zap.String("path", file))
+		select {
+		case filesC <- item:
+		case <-a.ctx.Done():
+			if item.localPath != "" {
+				util.MustRemoveFile(item.localPath, a.logger)
+			}
+			return items, a.ctx.Err()
+		}
+		items++
+	}
+}
+
+// continuously receive files extracted from the base backup archives and upload them to remote storage
+func (a *app) stagedBackupWorker(filesC <-chan stagedFile, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		f, more := <-filesC
+		if !more {
+			a.logger.Debug("No more files to process")
+			return
+		}
+		// once asked to stop, just drain the channel, cleaning up the temporary files
+		if a.interrupted() {
+			if f.localPath != "" {
+				util.MustRemoveFile(f.localPath, a.logger)
+			}
+			continue
+		}
+
+		if f.directory {
+			if err := a.backupDirectory(f.path, f.mtime, f.attrs); err != nil {
+				a.fail("Failed to create object for directory on remote storage", f.path, err)
+			}
+			continue
+		}
+
+		err := a.backupFile(f.path, f.localPath, f.size, f.mtime, f.attrs, nil)
+		// cleanup the temporary file
+		util.MustRemoveFile(f.localPath, a.logger)
+		if err != nil {
+			a.fail("Failed to upload file", f.path, err)
+		}
+	}
+}
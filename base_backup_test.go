@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestBaseBackupCommand(t *testing.T) {
+	name := "it's"
+	checkpoint, noWait, noVerify := true, false, true
+	a := &app{runState: &runState{}}
+	a.backupName = &name
+	a.backupCheckpoint = &checkpoint
+	a.noWaitForArchive = &noWait
+	a.noVerifyChecksums = &noVerify
+
+	tests := []struct {
+		serverVersion int
+		expected      string
+	}{
+		{100000, "BASE_BACKUP LABEL 'it''s' PROGRESS TABLESPACE_MAP FAST"},
+		{140000, "BASE_BACKUP LABEL 'it''s' PROGRESS TABLESPACE_MAP FAST NOVERIFY_CHECKSUMS"},
+		{150000, "BASE_BACKUP (LABEL 'it''s', CHECKPOINT 'fast', WAIT true, TABLESPACE_MAP, PROGRESS, " +
+			"MANIFEST 'no', VERIFY_CHECKSUMS false)"},
+	}
+	for _, test := range tests {
+		a.serverVersion = test.serverVersion
+		if cmd := a.baseBackupCommand(); cmd != test.expected {
+			t.Errorf("%d: expected %q, got %q", test.serverVersion, test.expected, cmd)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// the page checksum algorithm below is a port of PG's (see src/include/storage/checksum_impl.h)
+
+const (
+	checksumNSums    = 32
+	checksumFNVPrime = 16777619
+	// size of a relation segment file, in bytes (RELSEG_SIZE * BLCKSZ)
+	relationSegmentSize = 1024 * 1024 * 1024
+)
+
+// base offsets to initialize each of the parallel FNV hashes into a different initial state
+var checksumBaseOffsets = [checksumNSums]uint32{
+	0x5B1F36E9, 0xB8525960, 0x02AB50AA, 0x1DE66D2A,
+	0x79FF467A, 0x9BB9F8A3, 0x217E7CD2, 0x83E13D2C,
+	0xF8D4474F, 0xE39EB970, 0x42C6AE16, 0x993216FA,
+	0x7B093B5D, 0x98DAFF3C, 0xF718902A, 0x0B1C9CDB,
+	0xE58F764B, 0x187636BC, 0x5D7B3BB1, 0xE73DE7DE,
+	0x92BEC979, 0xCCA6C0B2, 0x304A0979, 0x85AA43D4,
+	0x783125BB, 0x6CA8EAA2, 0xE407EAC6, 0x4B5CFC3E,
+	0x9FBF8C76, 0x15CA20BE, 0xF2CA9FFF, 0x3ED19DEA,
+}
+
+func checksumComp(checksum uint32, value uint32) uint32 {
+	tmp := checksum ^ value
+
+	return tmp*checksumFNVPrime ^ (tmp >> 17)
+}
+
+// pageChecksum computes the checksum of page (a full block of a relation), which is block number blkno of the
+// relation; the checksum stored in the page header is ignored
+func pageChecksum(page []byte, blkno uint32) uint16 {
+	sums := checksumBaseOffsets
+	words := len(page) / 4
+	for i := 0; i < words; i += checksumNSums {
+		for j := 0; j < checksumNSums; j++ {
+			offset := (i + j) * 4
+			value := binary.LittleEndian.Uint32(page[offset:])
+			// the checksum itself (pd_checksum, bytes 8-9) is taken as zero
+			if offset == 8 {
+				value &= 0xFFFF0000
+			}
+			sums[j] = checksumComp(sums[j], value)
+		}
+	}
+
+	// two rounds of zeroes for additional mixing
+	for i := 0; i < 2; i++ {
+		for j := 0; j < checksumNSums; j++ {
+			sums[j] = checksumComp(sums[j], 0)
+		}
+	}
+
+	// xor fold the partial checksums together
+	result := uint32(0)
+	for _, s := range sums {
+		result ^= s
+	}
+	result ^= blkno
+
+	return uint16(result%65535 + 1)
+}
+
+// pageLSN returns the LSN of the last change to page, as stored in its header
+func pageLSN(page []byte) uint64 {
+	return uint64(binary.LittleEndian.Uint32(page[0:]))<<32 | uint64(binary.LittleEndian.Uint32(page[4:]))
+}
+
+// pageIsNew returns true iff page was never initialized (pd_upper is 0), in which case it has no checksum
+func pageIsNew(page []byte) bool {
+	return binary.LittleEndian.Uint16(page[14:]) == 0
+}
+
+// return true iff the contents of file (relative to the data directory) should be verified, i.e., it's a relation
+// file, which PG keeps either in global or in the directory of a database
+func isChecksummedFile(file string) bool {
+	if !relationFileRE.MatchString(filepath.Base(file)) {
+		return false
+	}
+	dir := filepath.Dir(file)
+
+	return dir == "global" || isRelationDirectory(dir)
+}
+
+// pageVerifier checks the checksum of each page of a relation file as it's written to it, i.e., as the file is read to
+// be backed up, so that the pages verified are the ones stored. A nil pageVerifier ignores what's written to it.
+//
+// pages changed after the backup started are skipped, as they may be torn by a concurrent write and WAL replay
+// overwrites them anyway; a page that fails verification is read once more before being reported, for the same reason
+type pageVerifier struct {
+	a *app
+	// the relation file, relative to the data directory, and its full path
+	pgFile string
+	path   string
+	// number of the first block of the file, which is not 0 for segments other than the first one
+	firstBlock uint32
+	// blocks seen so far, and the contents of the current one
+	blocks  uint32
+	page    []byte
+	pending int
+	// blocks whose checksum does not match
+	failures []uint32
+	err      error
+}
+
+// newPageVerifier returns a verifier for the relation file at path (pgFile relative to the data directory)
+func (a *app) newPageVerifier(pgFile string, path string) (*pageVerifier, error) {
+	// relations larger than 1GB are split into segments named <relfilenode>.<segment number>
+	firstBlock := uint32(0)
+	if i := strings.LastIndex(filepath.Base(pgFile), "."); i >= 0 {
+		segment, err := strconv.ParseUint(filepath.Base(pgFile)[i+1:], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		firstBlock = uint32(segment) * (relationSegmentSize / uint32(a.blockSize))
+	}
+
+	return &pageVerifier{
+		a:          a,
+		pgFile:     pgFile,
+		path:       path,
+		firstBlock: firstBlock,
+		page:       make([]byte, a.blockSize),
+		failures:   make([]uint32, 0),
+	}, nil
+}
+
+// Write verifies every page completed by p; a partial page at the end means the relation is being extended, WAL
+// replay takes care of it. It never fails, so as not to stop the backup of the file.
+func (v *pageVerifier) Write(p []byte) (int, error) {
+	if v == nil {
+		return len(p), nil
+	}
+
+	for written := 0; written < len(p); {
+		n := copy(v.page[v.pending:], p[written:])
+		written += n
+		v.pending += n
+		if v.pending < len(v.page) {
+			break
+		}
+		v.verify()
+		v.blocks++
+		v.pending = 0
+	}
+
+	return len(p), nil
+}
+
+// result returns the numbers of the blocks whose checksum does not match, and the error that stopped the verification
+// early, if any
+func (v *pageVerifier) result() ([]uint32, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	return v.failures, v.err
+}
+
+// verify the current page
+func (v *pageVerifier) verify() {
+	blkno := v.firstBlock + v.blocks
+	if v.err != nil || v.a.pageChecksumMatches(v.page, blkno) {
+		return
+	}
+
+	// maybe it was being written to while we read it
+	page, err := v.reread()
+	if err != nil {
+		v.err = err
+		return
+	}
+	if !v.a.pageChecksumMatches(page, blkno) {
+		v.a.logger.Warn("Page checksum verification failed", zap.String("path", v.pgFile), zap.Uint32("block", blkno))
+		v.failures = append(v.failures, blkno)
+	}
+}
+
+// read the current page from the file again
+func (v *pageVerifier) reread() ([]byte, error) {
+	f, err := os.Open(v.path)
+	if err != nil {
+		return nil, err
+	}
+	// we open this for read only; there's no need to throw an error if closing it fails
+	defer f.Close()
+
+	page := make([]byte, len(v.page))
+	if _, err := f.ReadAt(page, int64(v.blocks)*int64(len(v.page))); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// return true iff page has a valid checksum or does not need one to be verified
+func (a *app) pageChecksumMatches(page []byte, blkno uint32) bool {
+	if pageIsNew(page) || pageLSN(page) >= a.startLSNValue {
+		return true
+	}
+
+	return pageChecksum(page, blkno) == binary.LittleEndian.Uint16(page[8:])
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+const testBlockSize = 8192
+
+// heapPage returns a heap page holding a single 32 byte tuple, as laid out by PG
+func heapPage() []byte {
+	page := make([]byte, testBlockSize)
+	// pd_lsn, pd_checksum, pd_flags, pd_lower, pd_upper, pd_special, pd_pagesize_version, pd_prune_xid
+	binary.LittleEndian.PutUint32(page[0:], 0x1)
+	binary.LittleEndian.PutUint32(page[4:], 0x01A2B3C8)
+	binary.LittleEndian.PutUint16(page[12:], 28)
+	binary.LittleEndian.PutUint16(page[14:], 8160)
+	binary.LittleEndian.PutUint16(page[16:], 8192)
+	binary.LittleEndian.PutUint16(page[18:], 0x2004)
+	// one normal line pointer to the tuple
+	binary.LittleEndian.PutUint32(page[24:], 8160|1<<15|32<<17)
+	for i := 8160; i < testBlockSize; i++ {
+		page[i] = byte(i * 7)
+	}
+
+	return page
+}
+
+// noisePage returns a page full of pseudo-random bytes
+func noisePage() []byte {
+	page := make([]byte, testBlockSize)
+	x := uint32(12345)
+	for i := range page {
+		x = x*1103515245 + 12345
+		page[i] = byte(x >> 24)
+	}
+
+	return page
+}
+
+func TestPageChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		page     []byte
+		blkno    uint32
+		expected uint16
+	}{
+		{"heap page", heapPage(), 0, 31628},
+		{"heap page, block 7", heapPage(), 7, 31629},
+		{"heap page, second segment", heapPage(), 131075, 31627},
+		{"noise", noisePage(), 0, 47944},
+		{"noise, block 7", noisePage(), 7, 47941},
+		{"noise, second segment", noisePage(), 131075, 47943},
+	}
+
+	for _, test := range tests {
+		if checksum := pageChecksum(test.page, test.blkno); checksum != test.expected {
+			t.Errorf("%s: expected checksum %d, got %d", test.name, test.expected, checksum)
+		}
+		// the checksum stored in the page does not take part
+		binary.LittleEndian.PutUint16(test.page[8:], 0xBEEF)
+		if checksum := pageChecksum(test.page, test.blkno); checksum != test.expected {
+			t.Errorf("%s: expected checksum %d with pd_checksum set, got %d", test.name, test.expected, checksum)
+		}
+	}
+}
+
+func TestPageVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgCarpenter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// three good pages, a corrupted one, a new one, and the beginning of another
+	var contents []byte
+	for blkno := uint32(0); blkno < 3; blkno++ {
+		page := heapPage()
+		binary.LittleEndian.PutUint16(page[8:], pageChecksum(page, 131072+blkno))
+		contents = append(contents, page...)
+	}
+	corrupted := heapPage()
+	binary.LittleEndian.PutUint16(corrupted[8:], pageChecksum(corrupted, 131072+3))
+	corrupted[8170] ^= 0xFF
+	contents = append(contents, corrupted...)
+	contents = append(contents, make([]byte, testBlockSize)...)
+	contents = append(contents, heapPage()[:100]...)
+
+	path := filepath.Join(dir, "16384.1")
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &app{logger: zap.NewNop(), runState: &runState{blockSize: testBlockSize, startLSNValue: 0x2<<32 | 0}}
+	v, err := a.newPageVerifier("base/1/16384.1", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// written in chunks that don't line up with pages
+	r := bytes.NewReader(contents)
+	buf := make([]byte, 3000)
+	for {
+		n, _ := r.Read(buf)
+		if n == 0 {
+			break
+		}
+		v.Write(buf[:n])
+	}
+
+	failures, err := v.result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 1 || failures[0] != 131072+3 {
+		t.Errorf("expected block %d to fail verification, got %v", 131072+3, failures)
+	}
+
+	// pages changed since the backup started are not verified
+	a.startLSNValue = 0x1<<32 | 0x01A2B3C8
+	v, _ = a.newPageVerifier("base/1/16384.1", path)
+	v.Write(contents)
+	if failures, _ := v.result(); len(failures) != 0 {
+		t.Errorf("expected pages changed after the backup started to be skipped, got %v", failures)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/akamensky/argparse"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// read if it exists and no other configuration file is given
+	defaultConfigFile = "/etc/pgcarpenter.yaml"
+	// environment variables named after flags: --s3-bucket is PGCARPENTER_S3_BUCKET
+	envPrefix = "PGCARPENTER_"
+)
+
+// config holds the settings read from the environment and the configuration file, which are used as the defaults
+// of the command line flags. The precedence is: flags, environment variables, configuration file, built-in defaults.
+// The configuration file is a YAML map keyed by the long name of the flags, e.g.:
+//
+//	s3-bucket: my-backups
+//	password: secret
+//	exclude:
+//	  - pg_replslot/*
+//
+// or the equivalent TOML table, if its name ends in .toml:
+//
+//	s3-bucket = "my-backups"
+//	password = "secret"
+//	exclude = ["pg_replslot/*"]
+//
+// Settings that are only meaningful for a single invocation (the name of the backup, the WAL segment) are not
+// read from either.
+type config struct {
+	path   string
+	values map[string]interface{}
+	errors []error
+	// boolean flags along with the flags turning them off, see flag
+	negations []negation
+}
+
+type negation struct {
+	flag    *bool
+	negated *bool
+}
+
+// loadConfig reads the configuration file given by --config or PGCARPENTER_CONFIG, or the default one if it
+// exists. A missing file is only an error when it was explicitly asked for.
+func loadConfig(args []string) *config {
+	c := &config{values: make(map[string]interface{})}
+
+	path, explicit := argValue(args, "--config")
+	if !explicit {
+		path, explicit = os.LookupEnv(envPrefix + "CONFIG")
+	}
+	if !explicit {
+		path = defaultConfigFile
+	}
+	c.path = path
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return c
+	}
+	if err != nil {
+		c.errors = append(c.errors, err)
+		return c
+	}
+	unmarshal := yaml.Unmarshal
+	if filepath.Ext(path) == ".toml" {
+		unmarshal = toml.Unmarshal
+	}
+	if err := unmarshal(contents, &c.values); err != nil {
+		c.errors = append(c.errors, fmt.Errorf("failed to parse %s: %v", path, err))
+		return c
+	}
+	for name := range c.values {
+		if !isConfigSetting(name) {
+			c.errors = append(c.errors, fmt.Errorf("unknown setting in %s: %s", path, name))
+		}
+	}
+
+	// secrets in a file anyone can read are not much better than secrets in the process' arguments
+	for _, secret := range []string{"password", "api-token"} {
+		if _, ok := c.values[secret]; !ok {
+			continue
+		}
+		if st, err := os.Stat(path); err == nil && st.Mode().Perm()&0077 != 0 {
+			c.errors = append(c.errors, errors.New(path+" contains a "+secret+" but is accessible by other users"))
+		}
+	}
+
+	return c
+}
+
+// return the raw value of setting name (the long name of a flag), from either the environment or the
+// configuration file, and whether it was set at all
+func (c *config) lookup(name string) (interface{}, bool) {
+	if v, ok := os.LookupEnv(envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))); ok {
+		return v, true
+	}
+	v, ok := c.values[name]
+
+	return v, ok
+}
+
+// has returns true iff setting name was set in either the environment or the configuration file
+func (c *config) has(name string) bool {
+	_, ok := c.lookup(name)
+
+	return ok
+}
+
+// stringValue returns the value of setting name, or def if it's not set
+func (c *config) stringValue(name string, def string) string {
+	v, ok := c.lookup(name)
+	if !ok {
+		return def
+	}
+
+	return fmt.Sprint(v)
+}
+
+// intValue returns the value of setting name, or def if it's not set or is not a number
+func (c *config) intValue(name string, def int) int {
+	v, ok := c.lookup(name)
+	if !ok {
+		return def
+	}
+	if i, ok := v.(int); ok {
+		return i
+	}
+
+	i, err := strconv.Atoi(fmt.Sprint(v))
+	if err != nil {
+		c.errors = append(c.errors, fmt.Errorf("invalid value for %s: %v", name, v))
+		return def
+	}
+
+	return i
+}
+
+// boolValue returns the value of setting name, or def if it's not set or is not a boolean
+func (c *config) boolValue(name string, def bool) bool {
+	v, ok := c.lookup(name)
+	if !ok {
+		return def
+	}
+	if b, ok := v.(bool); ok {
+		return b
+	}
+
+	b, err := strconv.ParseBool(fmt.Sprint(v))
+	if err != nil {
+		c.errors = append(c.errors, fmt.Errorf("invalid value for %s: %v", name, v))
+		return def
+	}
+
+	return b
+}
+
+// flag adds the boolean flag name to parser, defaulting to the setting of the same name. Flags can only be turned
+// on, so it also adds the opposite flag (--no-<name>, or --<name> without the "no-" prefix) to turn off a setting
+// enabled in the environment or the configuration file. The value is final once applyNegations is called.
+func (c *config) flag(parser *argparse.Command, name string, help string) *bool {
+	flag := parser.Flag(
+		"",
+		name,
+		&argparse.Options{
+			Required: false,
+			Default:  c.boolValue(name, false),
+			Help:     help})
+
+	opposite := "no-" + name
+	if strings.HasPrefix(name, "no-") {
+		opposite = strings.TrimPrefix(name, "no-")
+	}
+	negated := parser.Flag(
+		"",
+		opposite,
+		&argparse.Options{
+			Required: false,
+			Help:     "Undo --" + name + " set in the environment or the configuration file"})
+	c.negations = append(c.negations, negation{flag: flag, negated: negated})
+
+	return flag
+}
+
+// applyNegations turns off the flags whose opposite was given on the command line; it must be called once the
+// command line is parsed
+func (c *config) applyNegations() {
+	for _, n := range c.negations {
+		if *n.negated {
+			*n.flag = false
+		}
+	}
+}
+
+// listValue returns the value of setting name, or def if it's not set; in the environment, the items of a list are
+// separated by commas
+func (c *config) listValue(name string, def []string) []string {
+	v, ok := c.lookup(name)
+	if !ok {
+		return def
+	}
+
+	switch v := v.(type) {
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		return items
+	case string:
+		return strings.Split(v, ",")
+	}
+
+	return []string{fmt.Sprint(v)}
+}
+
+// the settings that can be read from the environment or the configuration file
+func isConfigSetting(name string) bool {
+	switch name {
+	case "s3-region", "s3-bucket", "s3-max-retries", "data-directory", "workers", "tmp", "wait", "verbose",
+		"max-upload-rate", "max-download-rate", "max-read-rate",
+		"notify-command", "notify-url", "notify-event", "notify-archive-failures",
+		"conninfo", "host", "port", "dbname", "user", "password", "sslmode",
+		"checkpoint", "no-wait-for-archive", "standby", "replication", "archive-timeout", "statement-timeout",
+		"compress-threshold", "deduplicate", "exclude", "no-verify-checksums", "fail-on-corruption", "resume",
+		"pre-backup-cmd", "post-backup-cmd",
+		"modified-only", "delta", "force", "owner", "tablespace-map", "state-file", "pre-restore-cmd", "post-restore-cmd",
+		"slot", "create-slot", "status-interval", "partial-interval",
+		"listen", "interval", "textfile", "wal-lag",
+		"backup-schedule", "retention-schedule", "retain", "jitter", "no-catch-up", "status-listen",
+		"api-token":
+		return true
+	}
+
+	return false
+}
+
+// argValue returns the value given to flag on the command line (as either "flag value" or "flag=value"), and
+// whether it was given at all
+func argValue(args []string, flag string) (string, bool) {
+	for i, arg := range args {
+		if arg == flag && i+1 < len(args) {
+			return args[i+1], true
+		}
+		if strings.HasPrefix(arg, flag+"=") {
+			return arg[len(flag)+1:], true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// connInfo returns the libpq connection string used to connect to PG. Following libpq, the precedence order is
+// flags, --conninfo, the service file, environment variables (handled by pgx), and defaults.
+func (a *app) connInfo() (string, error) {
+	params := make(map[string]string)
+	if *a.pgConnInfo != "" {
+		p, err := parseConnInfo(*a.pgConnInfo)
+		if err != nil {
+			return "", err
+		}
+		params = p
+	}
+
+	// parameters from the service file only apply if not set on the connection string
+	service, ok := params["service"]
+	if !ok {
+		service = os.Getenv("PGSERVICE")
+	}
+	if service != "" {
+		path, p, err := readServiceFile(service)
+		if err != nil {
+			return "", err
+		}
+		for k, v := range p {
+			if _, ok := params[k]; !ok {
+				params[k] = v
+			}
+		}
+		// pgx only looks for services in the user's service file, point it to the one that defines it
+		params["service"] = service
+		params["servicefile"] = path
+	}
+
+	// explicitly set flags take precedence over everything else
+	flags := map[string]string{
+		"host":     *a.pgHost,
+		"dbname":   *a.pgDatabase,
+		"user":     *a.pgUser,
+		"password": *a.pgPassword,
+		"sslmode":  *a.sslMode,
+	}
+	if *a.pgPort != 0 {
+		flags["port"] = strconv.Itoa(*a.pgPort)
+	}
+	for k, v := range flags {
+		if v != "" {
+			params[k] = v
+		}
+	}
+
+	// defaults, unless set through the environment
+	defaults := []struct{ key, env, value string }{
+		{"user", "PGUSER", "postgres"},
+		{"sslmode", "PGSSLMODE", "disable"},
+		{"application_name", "PGAPPNAME", "pgCarpenter"},
+	}
+	for _, d := range defaults {
+		if _, ok := params[d.key]; !ok && os.Getenv(d.env) == "" {
+			params[d.key] = d.value
+		}
+	}
+
+	return formatConnInfo(params), nil
+}
+
+// formatConnInfo builds a keyword/value connection string, quoting every value
+func formatConnInfo(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	escaper := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"='"+escaper.Replace(params[k])+"'")
+	}
+
+	return strings.Join(pairs, " ")
+}
+
+// parseConnInfo parses a libpq connection string, either in the keyword/value or the URI format
+func parseConnInfo(s string) (map[string]string, error) {
+	for _, scheme := range []string{"postgres://", "postgresql://"} {
+		if strings.HasPrefix(s, scheme) {
+			return parseConnURI(strings.TrimPrefix(s, scheme))
+		}
+	}
+
+	params := make(map[string]string)
+	r := []rune(s)
+	i := 0
+	skipSpaces := func() {
+		for i < len(r) && isConnInfoSpace(r[i]) {
+			i++
+		}
+	}
+
+	for {
+		skipSpaces()
+		if i == len(r) {
+			return params, nil
+		}
+
+		// keyword
+		start := i
+		for i < len(r) && r[i] != '=' && !isConnInfoSpace(r[i]) {
+			i++
+		}
+		key := string(r[start:i])
+		skipSpaces()
+		if i == len(r) || r[i] != '=' || key == "" {
+			return nil, fmt.Errorf("missing \"=\" after %q in connection info string", key)
+		}
+		i++
+		skipSpaces()
+
+		// value, either quoted or ending at the first unescaped space
+		quoted := i < len(r) && r[i] == '\''
+		if quoted {
+			i++
+		}
+		value := make([]rune, 0)
+		for ; i < len(r); i++ {
+			if r[i] == '\\' && i+1 < len(r) {
+				i++
+				value = append(value, r[i])
+				continue
+			}
+			if (quoted && r[i] == '\'') || (!quoted && isConnInfoSpace(r[i])) {
+				break
+			}
+			value = append(value, r[i])
+		}
+		if quoted {
+			if i == len(r) {
+				return nil, errors.New("unterminated quoted string in connection info string")
+			}
+			// skip the closing quote
+			i++
+		}
+
+		params[key] = string(value)
+	}
+}
+
+// parseConnURI parses what follows the scheme of a libpq connection URI, i.e.,
+// [user[:password]@][host][:port][,...][/dbname][?keyword=value[&...]], into keyword/value parameters. Unlike in URLs
+// in general, hosts may be percent-encoded (e.g., the path of a Unix domain socket).
+func parseConnURI(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	// set the keyword to the percent-decoded value, if any
+	set := func(keyword string, value string) error {
+		if value == "" {
+			return nil
+		}
+		v, err := url.PathUnescape(value)
+		if err != nil {
+			return fmt.Errorf("invalid percent-encoding in connection URI: %s", value)
+		}
+		params[keyword] = v
+		return nil
+	}
+
+	query := ""
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		s, query = s[:i], s[i+1:]
+	}
+	dbname := ""
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		s, dbname = s[:i], s[i+1:]
+	}
+	if i := strings.LastIndexByte(s, '@'); i >= 0 {
+		user, password := s[:i], ""
+		if j := strings.IndexByte(user, ':'); j >= 0 {
+			user, password = user[:j], user[j+1:]
+		}
+		if err := set("user", user); err != nil {
+			return nil, err
+		}
+		if err := set("password", password); err != nil {
+			return nil, err
+		}
+		s = s[i+1:]
+	}
+
+	// each host may have its own port; IPv6 addresses are enclosed in brackets
+	hosts := make([]string, 0)
+	ports := make([]string, 0)
+	for _, h := range strings.Split(s, ",") {
+		port := ""
+		if strings.HasPrefix(h, "[") {
+			end := strings.IndexByte(h, ']')
+			if end < 0 {
+				return nil, errors.New("missing \"]\" in connection URI host: " + h)
+			}
+			h, port = h[1:end], strings.TrimPrefix(h[end+1:], ":")
+		} else if i := strings.LastIndexByte(h, ':'); i >= 0 {
+			h, port = h[:i], h[i+1:]
+		}
+		hosts = append(hosts, h)
+		ports = append(ports, port)
+	}
+	if strings.Join(ports, "") == "" {
+		ports = nil
+	}
+	for i := range ports {
+		if ports[i] == "" {
+			ports[i] = defaultPort()
+		}
+	}
+	if err := set("host", strings.Join(hosts, ",")); err != nil {
+		return nil, err
+	}
+	if err := set("port", strings.Join(ports, ",")); err != nil {
+		return nil, err
+	}
+	if err := set("dbname", dbname); err != nil {
+		return nil, err
+	}
+
+	// parameters in the query take precedence
+	for _, kv := range strings.Split(query, "&") {
+		if kv == "" {
+			continue
+		}
+		fields := strings.SplitN(kv, "=", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return nil, errors.New("missing \"=\" in connection URI parameter: " + kv)
+		}
+		keyword, err := url.PathUnescape(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid percent-encoding in connection URI: %s", fields[0])
+		}
+		if err := set(keyword, fields[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	return params, nil
+}
+
+// the port of hosts that don't have one, if some others do
+func defaultPort() string {
+	if port := os.Getenv("PGPORT"); port != "" {
+		return port
+	}
+
+	return "5432"
+}
+
+// like libpq, separators are spaces, tabs, and line breaks
+func isConnInfoSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+// readServiceFile returns the path of the service file that defines the given service, and its parameters. It
+// looks for it in the user's service file (PGSERVICEFILE or ~/.pg_service.conf) and then in the system-wide one
+// (pg_service.conf in PGSYSCONFDIR or, like libpq, in the directory PG was configured with).
+func readServiceFile(service string) (string, map[string]string, error) {
+	userFile := os.Getenv("PGSERVICEFILE")
+	if userFile == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			userFile = filepath.Join(home, ".pg_service.conf")
+		}
+	}
+	if userFile != "" {
+		params, err := readServiceFromFile(userFile, service)
+		if err != nil || params != nil {
+			return userFile, params, err
+		}
+	}
+
+	// the system-wide file is only looked for if needed
+	if dir := systemConfigDirectory(); dir != "" {
+		systemFile := filepath.Join(dir, "pg_service.conf")
+		params, err := readServiceFromFile(systemFile, service)
+		if err != nil || params != nil {
+			return systemFile, params, err
+		}
+	}
+
+	return "", nil, errors.New("definition of service not found: " + service)
+}
+
+// the directory pg_config reports PG was configured with, which only needs to be asked for once
+var pgConfigSysConfDir struct {
+	once sync.Once
+	dir  string
+}
+
+// return the directory of PG's system-wide configuration files: PGSYSCONFDIR if set, or what pg_config reports
+// (which varies by distribution), or nothing if pg_config isn't available either
+func systemConfigDirectory() string {
+	if dir := os.Getenv("PGSYSCONFDIR"); dir != "" {
+		return dir
+	}
+
+	pgConfigSysConfDir.once.Do(func() {
+		if out, err := exec.Command("pg_config", "--sysconfdir").Output(); err == nil {
+			pgConfigSysConfDir.dir = strings.TrimSpace(string(out))
+		}
+	})
+
+	return pgConfigSysConfDir.dir
+}
+
+// return the parameters of service as defined in the INI-like service file path, or nil if the file does not
+// exist or does not define it
+func readServiceFromFile(path string, service string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// we open this for read only; there's no need to throw an error if closing it fails
+	defer f.Close()
+
+	var params map[string]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			// we're done with the section of the service we're looking for
+			if params != nil {
+				break
+			}
+			if strings.TrimSuffix(line[1:], "]") == service {
+				params = make(map[string]string)
+			}
+			continue
+		}
+
+		if params != nil {
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("syntax error in service file %s: %s", path, line)
+			}
+			params[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	return params, scanner.Err()
+}
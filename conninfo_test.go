@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseConnInfo(t *testing.T) {
+	// the port of hosts without one
+	t.Setenv("PGPORT", "")
+
+	tests := []struct {
+		name     string
+		conninfo string
+		expected map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{"keywords", "host=db1 port=5433", map[string]string{"host": "db1", "port": "5433"}},
+		{"spaces around =", "host = db1  dbname= app", map[string]string{"host": "db1", "dbname": "app"}},
+		{"tabs and line breaks", "host=db1\tport=5433\n\tuser\t=\tapp\r\n", map[string]string{
+			"host": "db1", "port": "5433", "user": "app"}},
+		{"quoted", "password='a b' host=db1", map[string]string{"password": "a b", "host": "db1"}},
+		{"escaped", `password='it\'s' dbname=a\ b`, map[string]string{"password": "it's", "dbname": "a b"}},
+		{"empty value", "password='' host=db1", map[string]string{"password": "", "host": "db1"}},
+		{"uri", "postgres://app@db1:5433/app?sslmode=require", map[string]string{
+			"user": "app", "host": "db1", "port": "5433", "dbname": "app", "sslmode": "require"}},
+		{"uri with password", "postgresql://app:p%40ss:word@db1/app", map[string]string{
+			"user": "app", "password": "p@ss:word", "host": "db1", "dbname": "app"}},
+		{"uri without host", "postgres:///app?host=/var/run/postgresql", map[string]string{
+			"host": "/var/run/postgresql", "dbname": "app"}},
+		{"uri with socket", "postgres://%2Fvar%2Frun%2Fpostgresql/app", map[string]string{
+			"host": "/var/run/postgresql", "dbname": "app"}},
+		{"uri with hosts", "postgres://db1:5433,[::1]:5434,db3/app?target_session_attrs=read-write", map[string]string{
+			"host": "db1,::1,db3", "port": "5433,5434,5432", "dbname": "app", "target_session_attrs": "read-write"}},
+		{"uri with ipv6", "postgres://[::1]", map[string]string{"host": "::1"}},
+	}
+
+	for _, test := range tests {
+		params, err := parseConnInfo(test.conninfo)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(params, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, params)
+		}
+	}
+}
+
+func TestParseConnInfoErrors(t *testing.T) {
+	invalid := []string{
+		"host", "host db1", "host\tdb1", "=db1", "password='unterminated",
+		"postgres://db1/%zz", "postgres://[::1/app", "postgres://db1/app?sslmode", "postgres://db1/app?=require",
+	}
+	for _, conninfo := range invalid {
+		if _, err := parseConnInfo(conninfo); err == nil {
+			t.Errorf("%q: expected an error", conninfo)
+		}
+	}
+}
+
+func TestFormatConnInfo(t *testing.T) {
+	params := map[string]string{"host": "db1", "password": `it's a \ test`, "user": ""}
+	s := formatConnInfo(params)
+	if s != `host='db1' password='it\'s a \\ test' user=''` {
+		t.Errorf("unexpected connection string: %s", s)
+	}
+
+	parsed, err := parseConnInfo(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, params) {
+		t.Errorf("expected %v, got %v", params, parsed)
+	}
+}
+
+func TestReadServiceFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgCarpenter.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pg_service.conf")
+	contents := `# a comment
+[other]
+host=db2
+
+[app]
+host = db1
+ port=5433
+# another comment
+options=-c search_path=app
+
+[last]
+host=db3
+`
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := readServiceFromFile(path, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"host": "db1", "port": "5433", "options": "-c search_path=app"}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("expected %v, got %v", expected, params)
+	}
+
+	params, err = readServiceFromFile(path, "last")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(params, map[string]string{"host": "db3"}) {
+		t.Errorf("unexpected parameters of the last service: %v", params)
+	}
+
+	// not defined, or no such file
+	if params, err := readServiceFromFile(path, "missing"); params != nil || err != nil {
+		t.Errorf("expected no parameters and no error for an undefined service, got %v, %v", params, err)
+	}
+	if params, err := readServiceFromFile(filepath.Join(dir, "missing.conf"), "app"); params != nil || err != nil {
+		t.Errorf("expected no parameters and no error for a missing file, got %v, %v", params, err)
+	}
+
+	// a line that is not a keyword/value pair
+	if err := ioutil.WriteFile(path, []byte("[app]\nhost db1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readServiceFromFile(path, "app"); err == nil {
+		t.Error("expected a syntax error")
+	}
+}
+
+func TestReadServiceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgCarpenter.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	user := filepath.Join(dir, "user.conf")
+	system := filepath.Join(dir, "pg_service.conf")
+	if err := ioutil.WriteFile(user, []byte("[app]\nhost=db1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(system, []byte("[app]\nhost=db2\n[global]\nhost=db3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PGSERVICEFILE", user)
+	t.Setenv("PGSYSCONFDIR", dir)
+
+	// the user's file takes precedence over the system-wide one
+	path, params, err := readServiceFile("app")
+	if err != nil || path != user || params["host"] != "db1" {
+		t.Errorf("expected host db1 from %s, got %v from %s (%v)", user, params, path, err)
+	}
+	path, params, err = readServiceFile("global")
+	if err != nil || path != system || params["host"] != "db3" {
+		t.Errorf("expected host db3 from %s, got %v from %s (%v)", system, params, path, err)
+	}
+	if _, _, err := readServiceFile("missing"); err == nil {
+		t.Error("expected an error for an undefined service")
+	}
+}
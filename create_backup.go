@@ -3,7 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
-	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,54 +11,158 @@ import (
 	"time"
 
 	"github.com/akamensky/argparse"
-	_ "github.com/lib/pq"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/pierrec/lz4"
+	"github.com/thumbtack/pgCarpenter/throttle"
 	"github.com/thumbtack/pgCarpenter/util"
 	"go.uber.org/zap"
 )
 
-// there's no point on taking backups of directories like log or pg_xlog
-var prefixesNotToBackup = []string{"log", "pg_xlog", "postmaster.pid", "pg_replslot"}
+// how long cleaning up after an interrupted backup may take
+const abortTimeout = 60 * time.Second
 
-func (a *app) createBackup() int {
+func (a *app) createBackup() (exitCode int) {
 	a.logger.Info("Preparing to start backup", zap.String("name", *a.backupName))
 	begin := time.Now()
 
+	// a standby does not archive WAL, which we only know how to wait for when connected over SQL
+	if *a.replication && *a.standby {
+		a.logger.Error("Backups from a standby are not supported over the replication protocol")
+		return 1
+	}
+
 	backupKey := *a.backupName + "/"
 
-	// don't allow existing backups to be overwritten
-	_, err := a.storage.GetString(backupKey)
-	if err == nil {
+	// don't allow existing backups to be overwritten, unfinished ones may be resumed if asked to
+	_, err := a.storage.GetString(a.ctx, backupKey)
+	if err == nil && !*a.resume {
 		a.logger.Error("A backup with the same name already exists", zap.String("backup_name", *a.backupName))
 		return 1
 	}
+	if err == nil {
+		a.resumed, err = a.loadResumeState(*a.backupName)
+		if err != nil {
+			a.logger.Error("Failed to resume backup", zap.String("backup_name", *a.backupName), zap.Error(err))
+			return 1
+		}
+	}
+
+	// the user may want to prepare for the backup, or not take one at all
+	if err := a.runHook(a.ctx, "pre-backup", *a.preBackupCommand, ""); err != nil {
+		a.logger.Error("Pre-backup hook failed, not taking a backup", zap.Error(err))
+		return 1
+	}
+	defer func() { a.runPostHook("post-backup", *a.postBackupCommand, exitCode) }()
 
 	// create the top level "folder" so that the object actually exists and
 	// has all the relevant metadata like timestamps
-	if err := a.storage.PutString(backupKey, ""); err != nil {
+	if err := a.storage.PutString(a.ctx, backupKey, ""); err != nil {
 		a.logger.Error("Failed to create top-level backup folder", zap.Error(err))
 		return 1
 	}
 
-	// tell PG we're starting a base backup, copy all the file, tell PG we're done
-	db, err := a.startBackup()
-	if err != nil {
-		a.logger.Error("Failed to start backup", zap.Error(err))
-		return 1
+	// keep track of every file we upload; deduplicated backups need the manifest to be in place before
+	// uploading anything, otherwise garbage collection could remove objects this backup relies on, including the
+	// ones uploaded by the run being resumed
+	a.manifest = newManifest(*a.deduplicate)
+	a.manifest.StartTime = begin.Unix()
+	if a.resumed != nil {
+		a.manifest.seed(a.resumed.files)
+		// the carried over entries are only reused if their files did not change since the first run started
+		if a.resumed.startTime > 0 {
+			a.manifest.StartTime = a.resumed.startTime
+		}
+	}
+	if *a.deduplicate {
+		if err := a.putManifest(*a.backupName, a.manifest); err != nil {
+			a.logger.Error("Failed to create the backup manifest", zap.Error(err))
+			return 1
+		}
 	}
 
-	// copy all files to remote storage
-	items := a.uploadFiles()
+	// save the manifest periodically so that the backup can be resumed if interrupted
+	stopCheckpoints := a.checkpointManifest()
+	defer stopCheckpoints()
 
-	// tell PG we're done copying the data directory, save the tablespace map and backup label files
-	if err := a.stopBackup(db); err != nil {
-		a.logger.Error("Failed to stop backup", zap.Error(err))
+	var items int
+	if *a.replication {
+		// let the server send us the data directory
+		items, err = a.streamBaseBackup()
+		if err != nil && !a.interrupted() {
+			a.fail("Failed to stream base backup", *a.backupName, err)
+		}
+		// the server aborts the backup when the connection is closed
+		if a.failed() > 0 || a.interrupted() {
+			stopCheckpoints()
+			a.markAborted()
+			return a.reportFailures("Backup")
+		}
+	} else {
+		// tell PG we're starting a base backup, copy all the file, tell PG we're done
+		db, err := a.startBackup()
+		if err != nil {
+			a.logger.Error("Failed to start backup", zap.Error(err))
+			// an incomplete deduplicated backup would hold off garbage collection forever
+			stopCheckpoints()
+			a.markAborted()
+			return 1
+		}
+
+		// what to leave out of the backup depends on the server version
+		a.exclusions = newExclusionRules(*a.pgDataDirectory, a.serverVersion, *a.standby, *a.excludePatterns)
+
+		// copy all files to remote storage
+		items, err = a.uploadFiles(a.estimateSize(db))
+		if err != nil && !a.interrupted() {
+			a.fail("Failed to walk data directory", *a.pgDataDirectory, err)
+		}
+		// the backup is useless if any file is missing
+		if a.failed() > 0 || a.interrupted() {
+			stopCheckpoints()
+			a.abortBackup(db)
+			a.markAborted()
+			return a.reportFailures("Backup")
+		}
+
+		// tell PG we're done copying the data directory, save the tablespace map and backup label files
+		if err := a.stopBackup(db); err != nil {
+			a.logger.Error("Failed to stop backup", zap.Error(err))
+			stopCheckpoints()
+			a.markAborted()
+			return 1
+		}
+	}
+	stopCheckpoints()
+	a.manifest.ServerVersion = a.serverVersion
+
+	// save the manifest of the now complete backup
+	a.manifest.dropSeeded()
+	a.manifest.Complete = true
+	a.manifest.EndTime = time.Now().Unix()
+	if err := a.putManifest(*a.backupName, a.manifest); err != nil {
+		a.logger.Error("Failed to save the backup manifest", zap.Error(err))
+		a.manifest.Complete = false
+		a.markAborted()
 		return 1
 	}
 
+	// the manifest lists the corrupted pages either way, but the backup is only marked as successful if allowed
+	if failures := a.manifest.checksumFailures(); failures > 0 {
+		if *a.failOnCorruption {
+			a.logger.Error("Page checksum verification failed", zap.Int("pages", failures))
+			return 1
+		}
+		a.logger.Warn("Page checksum verification failed", zap.Int("pages", failures))
+	}
+
 	// mark the backup as successful
 	if err := a.putSuccessfulMarker(*a.backupName); err != nil {
 		a.logger.Error("Failed to mark backup as successfully completed", zap.Error(err))
+		return 1
+	}
+	// a resumed backup is no longer aborted
+	if err := a.deleteAbortedMarker(*a.backupName); err != nil {
+		a.logger.Error("Failed to delete aborted marker", zap.Error(err))
 	}
 
 	// update the LATEST marker
@@ -80,12 +184,15 @@ func (a *app) createBackup() int {
 func (a *app) startBackup() (*sql.Conn, error) {
 	a.logger.Info("Starting backup", zap.String("name", *a.backupName))
 	d := time.Now().Add(time.Duration(*a.statementTimeout) * time.Second)
-	ctx, cancel := context.WithDeadline(context.Background(), d)
+	ctx, cancel := context.WithDeadline(a.ctx, d)
 	defer cancel()
 
-	connStr := fmt.Sprintf("user=%s password='%s' sslmode=%s", *a.pgUser, *a.pgPassword, *a.sslMode)
+	connStr, err := a.connInfo()
+	if err != nil {
+		return nil, err
+	}
 
-	db, err := sql.Open("postgres", connStr)
+	db, err := sql.Open("pgx", connStr)
 	if err != nil {
 		return nil, err
 	}
@@ -95,14 +202,35 @@ func (a *app) startBackup() (*sql.Conn, error) {
 		return nil, err
 	}
 
-	_, err = conn.QueryContext(
-		ctx,
-		"SELECT pg_start_backup($1, $2, $3)",
-		*a.backupName,
-		*a.backupCheckpoint,
-		"false",
-	)
-	if err != nil {
+	// the server version determines which files to exclude from the backup
+	if err := conn.QueryRowContext(ctx, "SHOW server_version_num").Scan(&a.serverVersion); err != nil {
+		return nil, err
+	}
+	a.logger.Debug("Connected to PostgreSQL", zap.Int("server_version_num", a.serverVersion))
+
+	if err := a.checkRecoveryState(ctx, conn); err != nil {
+		return nil, err
+	}
+
+	// pg_start_backup was renamed to pg_backup_start in PG 15, which dropped the exclusive mode parameter
+	var row *sql.Row
+	if a.serverVersion >= 150000 {
+		row = conn.QueryRowContext(ctx, "SELECT pg_backup_start($1, $2)", *a.backupName, *a.backupCheckpoint)
+	} else {
+		row = conn.QueryRowContext(
+			ctx,
+			"SELECT pg_start_backup($1, $2, $3)",
+			*a.backupName,
+			*a.backupCheckpoint,
+			"false",
+		)
+	}
+	if err := row.Scan(&a.startLSN); err != nil {
+		return nil, err
+	}
+	a.logger.Info("Backup started", zap.String("lsn", a.startLSN))
+
+	if err := a.checkDataChecksums(ctx, conn); err != nil {
 		return nil, err
 	}
 
@@ -111,16 +239,84 @@ func (a *app) startBackup() (*sql.Conn, error) {
 	return conn, nil
 }
 
+// checkDataChecksums finds out whether page checksums are enabled, in which case they are verified while copying
+// relation files; pages changed after the backup started are not verified
+func (a *app) checkDataChecksums(ctx context.Context, conn *sql.Conn) error {
+	if *a.noVerifyChecksums {
+		return nil
+	}
+
+	var dataChecksums string
+	if err := conn.QueryRowContext(ctx, "SHOW data_checksums").Scan(&dataChecksums); err != nil {
+		return err
+	}
+	a.dataChecksums = dataChecksums == "on"
+	if !a.dataChecksums {
+		a.logger.Debug("Data checksums are disabled, not verifying pages")
+		return nil
+	}
+
+	if err := conn.QueryRowContext(ctx, "SHOW block_size").Scan(&a.blockSize); err != nil {
+		return err
+	}
+	startLSN, err := parseLSN(a.startLSN)
+	if err != nil {
+		return err
+	}
+	a.startLSNValue = startLSN
+	a.logger.Info("Verifying page checksums", zap.Int("block_size", a.blockSize))
+
+	return nil
+}
+
+// estimateSize returns the total size of the databases the backup user can see, which is most of the data directory,
+// to report progress against; it's 0 if unknown
+func (a *app) estimateSize(conn *sql.Conn) int64 {
+	ctx, cancel := context.WithTimeout(a.ctx, time.Duration(*a.statementTimeout)*time.Second)
+	defer cancel()
+
+	var size sql.NullInt64
+	err := conn.QueryRowContext(
+		ctx,
+		"SELECT sum(pg_database_size(oid))::bigint FROM pg_database WHERE has_database_privilege(oid, 'CONNECT')",
+	).Scan(&size)
+	if err != nil {
+		a.logger.Warn("Failed to estimate the size of the backup, progress will be reported without totals",
+			zap.Error(err))
+		return 0
+	}
+
+	return size.Int64
+}
+
 func (a *app) stopBackup(conn *sql.Conn) error {
 	a.logger.Info("Stopping backup", zap.String("name", *a.backupName))
-	var lsn, labelFile, mapFile string
-	ctx, cancel := context.WithCancel(context.Background())
+	var labelFile string
+	var mapFile sql.NullString
+	ctx, cancel := context.WithCancel(a.ctx)
 	defer cancel()
 
+	// pg_stop_backup was renamed to pg_backup_stop in PG 15; the option not to wait for WAL archiving
+	// was introduced in PG 10
+	waitForArchive := !*a.noWaitForArchive
+	stopFunction := "pg_stop_backup"
+	query := "SELECT lsn, labelfile, spcmapfile FROM pg_stop_backup(false)"
+	args := []interface{}{}
+	if a.serverVersion >= 150000 {
+		stopFunction = "pg_backup_stop"
+		query = "SELECT lsn, labelfile, spcmapfile FROM pg_backup_stop($1)"
+		args = append(args, waitForArchive)
+	} else if a.serverVersion >= 100000 {
+		query = "SELECT lsn, labelfile, spcmapfile FROM pg_stop_backup(false, $1)"
+		args = append(args, waitForArchive)
+	} else if !waitForArchive {
+		a.logger.Warn("Not waiting for WAL archiving requires PostgreSQL 10 or later, ignoring")
+	}
+
 	// print a short message to indicate we're just waiting for pg_stop_backup to complete
 	//
 	// pg_stop_backup will only succeed after all the necessary WAL has been
-	// archived, which may take a while
+	// archived (unless told otherwise), which may take a while
 	go func() {
 		for {
 			select {
@@ -128,17 +324,25 @@ func (a *app) stopBackup(conn *sql.Conn) error {
 				return
 			default:
 				time.Sleep(60 * time.Second)
-				a.logger.Info("Waiting for pg_stop_backup")
+				a.logger.Info("Waiting for " + stopFunction)
 			}
 		}
 
 	}()
 
-	row := conn.QueryRowContext(ctx, "SELECT * FROM pg_stop_backup(false)")
-	err := row.Scan(&lsn, &labelFile, &mapFile)
+	row := conn.QueryRowContext(ctx, query, args...)
+	err := row.Scan(&a.stopLSN, &labelFile, &mapFile)
 	if err != nil {
 		return err
 	}
+	a.logger.Info("Backup stopped", zap.String("lsn", a.stopLSN))
+
+	// the backup is only consistent once the standby has replayed everything up to the stop LSN
+	if *a.standby {
+		if err := a.waitForReplay(ctx, conn); err != nil {
+			return err
+		}
+	}
 
 	// explicitly close the connection we kept open throughout the backup
 	err = conn.Close()
@@ -148,16 +352,19 @@ func (a *app) stopBackup(conn *sql.Conn) error {
 
 	// upload the second field to a file named backup_label in the root directory of the backup and
 	// the third field to a file named tablespace_map, unless the field is empty
-	key := *a.backupName + "/backup_label"
-	err = a.storage.PutString(key, labelFile)
-	if err != nil {
+	if err := a.putBackupFile("backup_label", labelFile); err != nil {
 		return err
 	}
 
-	if mapFile != "" {
-		key = *a.backupName + "/tablespace_map"
-		err = a.storage.PutString(key, mapFile)
-		if err != nil {
+	if mapFile.Valid && mapFile.String != "" {
+		if err := a.putBackupFile("tablespace_map", mapFile.String); err != nil {
+			return err
+		}
+	}
+
+	// pg_stop_backup does not wait for WAL archiving on a standby, we have to do it ourselves
+	if *a.standby {
+		if err := a.waitForArchivedWAL(labelFile); err != nil {
 			return err
 		}
 	}
@@ -165,19 +372,72 @@ func (a *app) stopBackup(conn *sql.Conn) error {
 	return nil
 }
 
+// abortBackup tells PG we're done with a backup that failed, without waiting for any WAL to be archived, and closes
+// the connection; PG would abort the backup when the connection is closed anyway, but only after a while if the
+// network is gone
+func (a *app) abortBackup(conn *sql.Conn) {
+	a.logger.Info("Aborting backup", zap.String("name", *a.backupName))
+	// the context of the command may be canceled already
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*a.statementTimeout)*time.Second)
+	defer cancel()
+
+	query := "SELECT pg_stop_backup(false)"
+	if a.serverVersion >= 150000 {
+		query = "SELECT pg_backup_stop(false)"
+	} else if a.serverVersion >= 100000 {
+		query = "SELECT pg_stop_backup(false, false)"
+	}
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		a.logger.Warn("Failed to stop backup", zap.Error(err))
+	}
+
+	if err := conn.Close(); err != nil {
+		a.logger.Error("Failed to close connection", zap.Error(err))
+	}
+}
+
+// putBackupFile stores a file that is not part of the data directory (e.g., backup_label) in the root
+// directory of the backup and adds it to the manifest
+func (a *app) putBackupFile(name string, body string) error {
+	key := *a.backupName + "/" + name
+	if err := a.storage.PutString(a.ctx, key, body); err != nil {
+		return err
+	}
+
+	a.manifest.add(manifestEntry{Path: name, Key: key, Size: int64(len(body)), MTime: time.Now().Unix()})
+
+	return nil
+}
+
 func (a *app) getSuccessfulMarker(backupName string) string {
 	return filepath.Join(successfullyCompletedFolder, backupName)
 }
 
 func (a *app) putSuccessfulMarker(backupName string) error {
-	return a.storage.PutString(a.getSuccessfulMarker(backupName), "")
+	return a.storage.PutString(a.ctx, a.getSuccessfulMarker(backupName), "")
 }
 
 func (a *app) deleteSuccessfulMarker(backupName string) error {
 	key := a.getSuccessfulMarker(backupName)
-	_, err := a.storage.GetString(key)
+	_, err := a.storage.GetString(a.ctx, key)
+	if err == nil {
+		if err := a.storage.Delete(a.ctx, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *app) getAbortedMarker(backupName string) string {
+	return filepath.Join(abortedFolder, backupName)
+}
+
+func (a *app) deleteAbortedMarker(backupName string) error {
+	key := a.getAbortedMarker(backupName)
+	_, err := a.storage.GetString(a.ctx, key)
 	if err == nil {
-		if err := a.storage.Delete(key); err != nil {
+		if err := a.storage.Delete(a.ctx, key); err != nil {
 			return err
 		}
 	}
@@ -185,16 +445,44 @@ func (a *app) deleteSuccessfulMarker(backupName string) error {
 	return nil
 }
 
+// markAborted saves the manifest of a backup that did not complete, listing what was uploaded so that it can be
+// resumed, and marks the backup as aborted
+func (a *app) markAborted() {
+	a.logger.Warn("Marking backup as aborted", zap.String("name", *a.backupName))
+	// the context of the command may be canceled already
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+
+	a.manifest.Aborted = true
+	a.manifest.Failures = a.failed()
+	body, err := a.manifest.marshal()
+	if err == nil {
+		err = a.storage.PutString(ctx, a.getManifestKey(*a.backupName), body)
+	}
+	if err != nil {
+		a.logger.Error("Failed to save the backup manifest", zap.Error(err))
+	}
+
+	if err := a.storage.PutString(ctx, a.getAbortedMarker(*a.backupName), ""); err != nil {
+		a.logger.Error("Failed to mark backup as aborted", zap.Error(err))
+	}
+}
+
 func (a *app) updateLatest(backupName string) error {
-	return a.storage.PutString(latestKey, backupName)
+	return a.storage.PutString(a.ctx, latestKey, backupName)
 }
 
-// upload the data directory to remote storage; return the number of files uploaded
-func (a *app) uploadFiles() int {
+// upload the data directory to remote storage; return the number of files found. Failures to upload individual
+// files are recorded in the failure log.
+func (a *app) uploadFiles(totalBytes int64) (int, error) {
 	a.logger.Info("Preparing to upload files", zap.String("name", *a.backupName))
 	// channel to keep the path of all files that need to compressed and uploaded
 	filesC := make(chan string)
 
+	// the number of files is not known in advance
+	stopProgress := a.startProgress("Backup", 0, totalBytes)
+	defer stopProgress()
+
 	// spawn a pool of workers
 	a.logger.Info("Spawning workers", zap.Int("number", *a.nWorkers))
 	wg := &sync.WaitGroup{}
@@ -205,9 +493,24 @@ func (a *app) uploadFiles() int {
 
 	// traverse the data directory and put each file (relative path) in the channel for a worker to process
 	a.logger.Info("Traversing the data directory", zap.String("path", *a.pgDataDirectory))
+	items, err := a.walkFiles(*a.pgDataDirectory, filesC)
+
+	a.logger.Info("Waiting for all workers to finish")
+	close(filesC)
+	wg.Wait()
+
+	return items, err
+}
+
+// traverse the directory rooted at root (which must end with a slash so that symlinks are followed) and put the path
+// of each file, relative to the data directory, in filesC; return the number of files found
+//
+// tablespaces are symlinks in pg_tblspc which filepath.Walk does not follow, so they are traversed separately and
+// their files included under pg_tblspc/<OID>
+func (a *app) walkFiles(root string, filesC chan<- string) (int, error) {
 	items := 0
 	err := filepath.Walk(
-		*a.pgDataDirectory,
+		root,
 		func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				// files might change during the copy process; it's normal during an online backup
@@ -218,40 +521,57 @@ func (a *app) uploadFiles() int {
 				// anything other than the file not existing, on the other hand, is a problem
 				return err
 			}
+			// the root of a tablespace was already added when found in pg_tblspc
+			if path == root && root != *a.pgDataDirectory {
+				return nil
+			}
 			// grab just the path relative to the data directory
 			file := strings.TrimPrefix(path, *a.pgDataDirectory)
-			if a.ignoreFile(file) {
+			if file != "" && a.exclusions.excludeFile(file, info) {
 				a.logger.Debug("Ignoring file", zap.String("path", path))
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
 				return nil
 			}
 			a.logger.Debug("Adding file", zap.String("path", file))
-			filesC <- file
+			select {
+			case filesC <- file:
+			case <-a.ctx.Done():
+				return a.ctx.Err()
+			}
 			items++
-			return nil
-		},
-	)
-
-	if err != nil {
-		a.logger.Error("Failed to walk data directory", zap.Error(err))
-		return 1
-	}
 
-	a.logger.Info("Waiting for all workers to finish")
-	close(filesC)
-	wg.Wait()
+			// some directories must exist, but there's no point in taking backups of their contents
+			if info.IsDir() && a.exclusions.excludeContents(file) {
+				a.logger.Debug("Ignoring directory contents", zap.String("path", path))
+				// unlike WAL segments, the archive status directory must exist for archiving to work
+				if file == a.exclusions.walDirectory() {
+					archiveStatus := filepath.Join(file, "archive_status")
+					if _, err := os.Stat(filepath.Join(*a.pgDataDirectory, archiveStatus)); err == nil {
+						select {
+						case filesC <- archiveStatus:
+						case <-a.ctx.Done():
+							return a.ctx.Err()
+						}
+						items++
+					}
+				}
+				return filepath.SkipDir
+			}
 
-	return items
-}
+			if isTablespaceLink(file, info) {
+				a.logger.Info("Traversing tablespace", zap.String("path", file))
+				n, err := a.walkFiles(path+"/", filesC)
+				items += n
+				return err
+			}
 
-// return true iff it's in one of the directories we do not need to backup
-func (a *app) ignoreFile(path string) bool {
-	for _, d := range prefixesNotToBackup {
-		if strings.HasPrefix(path, d) {
-			return true
-		}
-	}
+			return nil
+		},
+	)
 
-	return false
+	return items, err
 }
 
 // continuously receive file paths (relative to the data directory) from the filesC channel
@@ -265,6 +585,10 @@ func (a *app) backupWorker(filesC <-chan string, wg *sync.WaitGroup) {
 			a.logger.Debug("No more files to process")
 			return
 		}
+		// once asked to stop, just drain the channel
+		if a.interrupted() {
+			continue
+		}
 
 		pgFilePath := filepath.Join(*a.pgDataDirectory, pgFile)
 		st, err := os.Stat(pgFilePath)
@@ -274,95 +598,271 @@ func (a *app) backupWorker(filesC <-chan string, wg *sync.WaitGroup) {
 			continue
 		}
 
-		// name the object after the file path relative to the data directory
-		key := filepath.Join(*a.backupName, pgFile)
-		// create directories
-		// some directories (e.g., pg_logical/mappings) need to exist even if empty otherwise
-		// PG, while fully functional, will continuously log an error message
+		attrs, err := readFileAttributes(pgFile, pgFilePath, st)
+		if err != nil {
+			a.logger.Info("Failed to read file attributes. Might have been removed", zap.Error(err))
+			continue
+		}
+
 		if st.IsDir() {
-			// append the extension that identifies this object as a directory
-			key += util.DirectoryExtension
-			a.logger.Debug(
-				"Creating object for directory directory",
-				zap.String("path", pgFile),
-				zap.String("key", key))
-			if err := a.storage.PutString(key, ""); err != nil {
-				a.logger.Fatal("Failed to create object for directory on remote storage", zap.Error(err))
+			if err := a.backupDirectory(pgFile, st.ModTime().Unix(), attrs); err != nil {
+				a.fail("Failed to create object for directory on remote storage", pgFile, err)
 			}
 			continue
 		}
-		// compress files larger than a given threshold
-		compressed := ""
-		if st.Size() > int64(*a.compressThreshold) {
-			a.logger.Debug("Compressing file", zap.String("path", pgFile), zap.Int64("size", st.Size()))
-			compressed, err = util.Compress(pgFilePath, *a.tmpDirectory)
-			if err != nil {
-				a.logger.Error("Failed to compress file", zap.Error(err))
-				// we use compressed == "" to decide whether to upload and remove a compressed file
-				// let's try to proceed with the backup by uploading the uncompressed file
-				compressed = ""
+
+		// files reused from an interrupted run of this backup were verified back then, others are verified as they
+		// are read to be uploaded
+		var verifier *pageVerifier
+		if _, ok := a.resumed.reuse(pgFile, st.Size(), st.ModTime().Unix()); ok {
+			if blocks := a.resumed.checksumFailures[pgFile]; len(blocks) > 0 {
+				a.manifest.addChecksumFailure(checksumFailure{Path: pgFile, Blocks: blocks})
+			}
+		} else if a.dataChecksums && isChecksummedFile(pgFile) {
+			if verifier, err = a.newPageVerifier(pgFile, pgFilePath); err != nil {
+				a.logger.Warn("Not verifying page checksums", zap.String("path", pgFile), zap.Error(err))
+			}
+		}
+
+		if err := a.backupFile(pgFile, pgFilePath, st.Size(), st.ModTime().Unix(), attrs, verifier); err != nil {
+			if os.IsNotExist(err) {
+				a.logger.Info("Failed to copy file. Might have been removed", zap.Error(err))
 				continue
 			}
-			// mark the object as a compressed file
-			key += lz4.Extension
+			a.fail("Failed to upload file", pgFile, err)
+			continue
 		}
 
-		if compressed != "" {
-			err = a.storage.Put(key, compressed, st.ModTime().Unix())
-			// cleanup the temporary compressed file
-			util.MustRemoveFile(compressed, a.logger)
-		} else {
-			err = a.storage.Put(key, pgFilePath, st.ModTime().Unix())
+		blocks, err := verifier.result()
+		if err != nil {
+			a.logger.Info("Failed to verify page checksums. Might have been removed", zap.Error(err))
+		}
+		if len(blocks) > 0 {
+			a.manifest.addChecksumFailure(checksumFailure{Path: pgFile, Blocks: blocks})
 		}
+	}
+}
+
+// backupDirectory records the directory pgFile (relative to the data directory) in the backup
+//
+// some directories (e.g., pg_logical/mappings) need to exist even if empty otherwise
+// PG, while fully functional, will continuously log an error message
+func (a *app) backupDirectory(pgFile string, mtime int64, attrs fileAttributes) error {
+	a.progress.add(1, 0)
+	a.manifest.add(manifestEntry{Path: pgFile, MTime: mtime, Directory: true, fileAttributes: attrs})
+	// deduplicated backups only keep track of directories in the manifest
+	if *a.deduplicate {
+		return nil
+	}
+
+	// name the object after the file path relative to the data directory and append the extension that
+	// identifies this object as a directory
+	key := filepath.Join(*a.backupName, pgFile) + util.DirectoryExtension
+	a.logger.Debug(
+		"Creating object for directory directory",
+		zap.String("path", pgFile),
+		zap.String("key", key))
+
+	return a.storage.PutString(a.ctx, key, "")
+}
+
+// backupFile uploads the local file localPath to remote storage as pgFile (relative to the data directory) along with
+// some relevant metadata; everything read from localPath is also written to verifier
+//
+// PG may modify the file at any time, so the checksum recorded in the manifest is always computed over the contents
+// read once, which are the ones uploaded. Files larger than compress-threshold are compressed into a temporary file,
+// which is uploaded. Smaller files are copied to a temporary file if deduplicated, as the content-addressed object is
+// named after the checksum, which must be known before uploading it; otherwise they're uploaded as they are read.
+func (a *app) backupFile(
+	pgFile string,
+	localPath string,
+	size int64,
+	mtime int64,
+	attrs fileAttributes,
+	verifier *pageVerifier) error {
+	defer a.progress.add(1, size)
+
+	// the file may have been uploaded already by an interrupted run of this backup
+	if e, ok := a.resumed.reuse(pgFile, size, mtime); ok {
+		a.logger.Debug("Skipping file already uploaded", zap.String("path", pgFile))
+		e.fileAttributes = attrs
+		a.manifest.add(e)
+		return nil
+	}
 
+	// name the object after the file path relative to the data directory
+	key := filepath.Join(*a.backupName, pgFile)
+
+	// compress files larger than a given threshold; the others are uploaded as they are read, unless their contents
+	// must be known before uploading them, i.e., to name a content-addressed object after them
+	var staged, checksum, extension string
+	var err error
+	switch {
+	case size > int64(*a.compressThreshold):
+		a.logger.Debug("Compressing file", zap.String("path", pgFile), zap.Int64("size", size))
+		staged, checksum, err = util.CompressWithHash(a.ctx, localPath, *a.tmpDirectory, a.readLimiter, verifier)
+		// mark the object as a compressed file
+		extension = lz4.Extension
+		key += extension
+	case *a.deduplicate:
+		staged, checksum, err = util.CopyWithHash(a.ctx, localPath, *a.tmpDirectory, a.readLimiter, verifier)
+	default:
+		checksum, err = a.putFile(key, localPath, mtime, verifier)
+	}
+	if err != nil {
+		return err
+	}
+
+	if staged != "" {
+		// cleanup the temporary file
+		defer util.MustRemoveFile(staged, a.logger)
+
+		uploaded := true
+		if *a.deduplicate {
+			key, uploaded, err = a.putContentAddressed(staged, extension, mtime)
+		} else {
+			err = a.storage.Put(a.ctx, key, staged, mtime)
+		}
 		if err != nil {
-			a.logger.Fatal("Failed to upload file", zap.Error(err))
+			return err
+		}
+		if st, err := os.Stat(staged); err == nil && uploaded {
+			a.manifest.addUploaded(st.Size())
 		}
 	}
+
+	a.manifest.add(manifestEntry{
+		Path:           pgFile,
+		Key:            key,
+		Size:           size,
+		MTime:          mtime,
+		Checksum:       checksum,
+		fileAttributes: attrs,
+	})
+
+	return nil
 }
 
-func parseCreateBackupArgs(cfg *app, parser *argparse.Command) {
-	cfg.compressThreshold = parser.Int(
+// putFile uploads the file at localPath to key as it reads it, no faster than the read limiter allows, and returns the
+// hex encoded SHA-256 digest of what it uploaded. Everything read is also written to tap.
+func (a *app) putFile(key string, localPath string, mtime int64, tap io.Writer) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	// we open this for read only; there's no need to throw an error if closing it fails
+	defer f.Close()
+
+	r := util.NewHashReader(throttle.NewReader(a.ctx, f, a.readLimiter), tap)
+	if err := a.storage.PutReader(a.ctx, key, r, mtime); err != nil {
+		return "", err
+	}
+	a.manifest.addUploaded(r.Size())
+
+	return r.Sum(), nil
+}
+
+// backupOptions are the options of create-backup, which the daemon shares
+type backupOptions struct {
+	backupCheckpoint  *bool
+	noWaitForArchive  *bool
+	standby           *bool
+	replication       *bool
+	archiveTimeout    *int
+	statementTimeout  *int
+	compressThreshold *int
+	deduplicate       *bool
+	excludePatterns   *[]string
+	noVerifyChecksums *bool
+	failOnCorruption  *bool
+	resume            *bool
+	preBackupCommand  *string
+	postBackupCommand *string
+}
+
+func parseCreateBackupArgs(cfg *app, parser *argparse.Command) backupOptions {
+	o := backupOptions{}
+	o.compressThreshold = parser.Int(
 		"",
 		"compress-threshold",
 		&argparse.Options{
 			Required: false,
-			Default:  512 * 1024,
+			Default:  cfg.config.intValue("compress-threshold", 512*1024),
 			Help:     "compress files larger than"})
-	cfg.pgUser = parser.String(
+	o.deduplicate = cfg.config.flag(
+		parser,
+		"deduplicate",
+		"Store file contents in a content-addressed folder shared by all backups, uploading only new ones")
+	o.excludePatterns = parser.List(
 		"",
-		"user",
+		"exclude",
 		&argparse.Options{
 			Required: false,
-			Default:  "postgres",
-			Help:     "PostgreSQL user"})
-	cfg.pgPassword = parser.String(
+			Validate: validateExcludePattern,
+			Default:  cfg.config.listValue("exclude", nil),
+			Help:     "Do not backup files (relative to the data directory) matching the given shell pattern (may be repeated)"})
+	o.resume = cfg.config.flag(
+		parser,
+		"resume",
+		"Resume an interrupted backup with the same name, skipping the files it already uploaded "+
+			"that did not change since")
+	o.preBackupCommand = parser.String(
 		"",
-		"password",
+		"pre-backup-cmd",
 		&argparse.Options{
 			Required: false,
-			Default:  "",
-			Help:     "PostgreSQL password"})
-	cfg.backupCheckpoint = parser.Flag(
+			Default:  cfg.config.stringValue("pre-backup-cmd", ""),
+			Help: "Run the given shell command before the backup, which is not taken if the command fails " +
+				"(the backup name and data directory are passed as PGCARPENTER_BACKUP and PGCARPENTER_DATA_DIRECTORY)"})
+	o.postBackupCommand = parser.String(
 		"",
-		"checkpoint",
+		"post-backup-cmd",
 		&argparse.Options{
 			Required: false,
-			Default:  false,
-			Help:     "Start the backup as soon as possible by issuing an checkpoint"})
-	cfg.sslMode = parser.Selector(
+			Default:  cfg.config.stringValue("post-backup-cmd", ""),
+			Help: "Run the given shell command after the backup, whether it succeeded or not (PGCARPENTER_STATUS), " +
+				"with the same environment as --pre-backup-cmd plus PGCARPENTER_START_LSN and PGCARPENTER_STOP_LSN"})
+	o.noVerifyChecksums = cfg.config.flag(
+		parser,
+		"no-verify-checksums",
+		"Do not verify page checksums, even if enabled on the cluster")
+	o.failOnCorruption = cfg.config.flag(
+		parser,
+		"fail-on-corruption",
+		"Do not mark the backup as successful if any page fails checksum verification "+
+			"(over the replication protocol the server always fails the backup)")
+	o.backupCheckpoint = cfg.config.flag(
+		parser,
+		"checkpoint",
+		"Start the backup as soon as possible by issuing an checkpoint")
+	o.noWaitForArchive = cfg.config.flag(
+		parser,
+		"no-wait-for-archive",
+		"Do not wait for the WAL required by the backup to be archived when stopping it "+
+			"(PostgreSQL 10+, make sure the WAL is archived before relying on the backup)")
+	o.replication = cfg.config.flag(
+		parser,
+		"replication",
+		"Take the backup over the streaming replication protocol (BASE_BACKUP) instead of reading the "+
+			"data directory, which is then not required")
+	o.standby = cfg.config.flag(
+		parser,
+		"standby",
+		"Take the backup from a streaming standby, waiting for the primary to archive the required WAL")
+	o.archiveTimeout = parser.Int(
 		"",
-		"sslmode",
-		[]string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"},
+		"archive-timeout",
 		&argparse.Options{
 			Required: false,
-			Default:  "disable",
-			Help:     "SSL certificate verification mode"})
-	cfg.statementTimeout = parser.Int(
+			Default:  cfg.config.intValue("archive-timeout", 3600),
+			Help:     "With --standby, fail if the required WAL is not replayed and archived within the given number of seconds"})
+	o.statementTimeout = parser.Int(
 		"",
 		"statement-timeout",
 		&argparse.Options{
 			Required: false,
-			Default:  60,
+			Default:  cfg.config.intValue("statement-timeout", 60),
 			Help:     "Cancel a start/stop backup statement if it takes more than the specified number of seconds"})
+
+	return o
 }
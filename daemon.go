@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+// backups created by the daemon are named after the time they started, e.g., 20240102T030405
+const daemonBackupNameFormat = "20060102T150405"
+
+// scheduledJob is a command the daemon runs periodically, along with the outcome of its last run
+type scheduledJob struct {
+	Name      string    `json:"name"`
+	Next      time.Time `json:"next"`
+	Running   bool      `json:"running"`
+	LastStart time.Time `json:"last_start"`
+	LastEnd   time.Time `json:"last_end"`
+	// exit code of the last run, as if it was run from the command line
+	LastExitCode int `json:"last_exit_code"`
+	// of the current run, if it got that far
+	Progress *progressStatus `json:"progress,omitempty"`
+
+	// the app the current run uses, nil when not running
+	current  *app
+	schedule cron.Schedule
+	// run with a fresh copy of the app, see newRun
+	run func(*app) int
+}
+
+// daemonState is shared by the scheduler and the HTTP server
+type daemonState struct {
+	mutex sync.Mutex
+	jobs  []*scheduledJob
+	// wakes up the scheduler when a job is triggered
+	wake chan struct{}
+}
+
+var errJobNotFound = errors.New("job not found")
+
+// snapshot returns a copy of the jobs, along with the progress of the one running
+func (s *daemonState) snapshot() []scheduledJob {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	jobs := make([]scheduledJob, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		job := *j
+		if j.current != nil {
+			job.Progress = j.current.currentProgress().status()
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs
+}
+
+// trigger makes the job with the given name due now
+func (s *daemonState) trigger(name string) (*scheduledJob, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, j := range s.jobs {
+		if j.Name != name {
+			continue
+		}
+		if j.Running {
+			return nil, errors.New("job already running: " + name)
+		}
+		j.Next = time.Now()
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+		return j, nil
+	}
+
+	return nil, errJobNotFound
+}
+
+// daemon runs backups and expires old ones according to cron schedules, one job at a time. A run that is missed
+// because another job was running (or because the daemon was not) is not repeated once per missed schedule: the job
+// runs once, as soon as possible, and goes back to its schedule afterwards.
+func (a *app) daemon() int {
+	backupSchedule, err := cron.ParseStandard(*a.backupSchedule)
+	if err != nil {
+		a.logger.Error("Invalid backup schedule", zap.String("schedule", *a.backupSchedule), zap.Error(err))
+		return 1
+	}
+	state := &daemonState{wake: make(chan struct{}, 1)}
+	now := time.Now()
+
+	backups := &scheduledJob{Name: "backup", schedule: backupSchedule, run: (*app).scheduledBackup}
+	backups.Next = a.jitter(backupSchedule.Next(now))
+	if !*a.noCatchUp && a.missedBackup(backupSchedule, now) {
+		a.logger.Info("The last scheduled backup was missed, running one now")
+		backups.Next = now
+	}
+	state.jobs = append(state.jobs, backups)
+
+	if *a.retain > 0 {
+		retentionSchedule, err := cron.ParseStandard(*a.retentionSchedule)
+		if err != nil {
+			a.logger.Error(
+				"Invalid retention schedule",
+				zap.String("schedule", *a.retentionSchedule),
+				zap.Error(err))
+			return 1
+		}
+		state.jobs = append(state.jobs, &scheduledJob{
+			Name:     "retention",
+			Next:     a.jitter(retentionSchedule.Next(now)),
+			schedule: retentionSchedule,
+			run:      (*app).expireBackups,
+		})
+	}
+
+	if *a.statusAddress != "" {
+		go a.serveStatus(state)
+	}
+
+	for {
+		// the job that is due first
+		state.mutex.Lock()
+		job := state.jobs[0]
+		for _, j := range state.jobs[1:] {
+			if j.Next.Before(job.Next) {
+				job = j
+			}
+		}
+		next := job.Next
+		state.mutex.Unlock()
+
+		a.logger.Info("Waiting for the next job", zap.String("job", job.Name), zap.Time("at", next))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-a.ctx.Done():
+			timer.Stop()
+			a.logger.Info("Stopping daemon")
+			return 0
+		case <-state.wake:
+			// a job was triggered, which may be due before this one
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		// every run starts from a clean slate
+		run := a.newRun()
+		state.mutex.Lock()
+		job.Running = true
+		job.LastStart = time.Now()
+		job.current = run
+		state.mutex.Unlock()
+
+		a.logger.Info("Running scheduled job", zap.String("job", job.Name))
+		exitCode := job.run(run)
+		if a.interrupted() {
+			a.logger.Info("Stopping daemon")
+			return 0
+		}
+
+		state.mutex.Lock()
+		job.Running = false
+		job.current = nil
+		job.LastEnd = time.Now()
+		job.LastExitCode = exitCode
+		job.Next = a.jitter(job.schedule.Next(job.LastEnd))
+		state.mutex.Unlock()
+
+		if exitCode != 0 {
+			a.logger.Error("Scheduled job failed", zap.String("job", job.Name), zap.Int("exit_code", exitCode))
+		}
+	}
+}
+
+// scheduledBackup creates a backup named after the current time
+func (a *app) scheduledBackup() int {
+	name := time.Now().UTC().Format(daemonBackupNameFormat)
+	a.backupName = &name
+
+	return a.withBackupNotifications(a.withLock("daemon create-backup "+name, a.createBackup))()
+}
+
+// expireBackups deletes all successful backups but the --retain most recent ones, along with aborted backups older
+// than the oldest backup kept; incomplete backups may still be running elsewhere and are left alone
+func (a *app) expireBackups() int {
+	type backup struct {
+		name      string
+		timestamp int64
+	}
+
+	keys, err := a.storage.ListFolder(a.ctx, "")
+	if err != nil {
+		a.logger.Error("Failed to list backups", zap.Error(err))
+		return 1
+	}
+
+	successful := make([]backup, 0)
+	aborted := make([]backup, 0)
+	for _, k := range keys {
+		name := strings.TrimSuffix(k, "/")
+		if isReservedFolder(name) {
+			continue
+		}
+
+		if completed, err := a.storage.GetLastModifiedTime(a.ctx, a.getSuccessfulMarker(name)); err == nil {
+			successful = append(successful, backup{name, completed})
+			continue
+		}
+		if _, err := a.storage.GetString(a.ctx, a.getAbortedMarker(name)); err == nil {
+			started, err := a.storage.GetLastModifiedTime(a.ctx, k)
+			if err != nil {
+				// without knowing how old it is, it's safer to keep it
+				a.logger.Warn("Failed to get the start time of aborted backup", zap.String("name", name), zap.Error(err))
+				continue
+			}
+			aborted = append(aborted, backup{name, started})
+		}
+	}
+	if len(successful) <= *a.retain {
+		a.logger.Info("No backups to expire", zap.Int("successful", len(successful)))
+		return 0
+	}
+
+	// most recent first
+	sort.Slice(successful, func(i, j int) bool {
+		return successful[i].timestamp > successful[j].timestamp
+	})
+	expired := successful[*a.retain:]
+	oldestKept := successful[*a.retain-1].timestamp
+	for _, b := range aborted {
+		if b.timestamp < oldestKept {
+			expired = append(expired, b)
+		}
+	}
+
+	exitCode := 0
+	for _, b := range expired {
+		a.logger.Info("Expiring backup", zap.String("name", b.name))
+		name := b.name
+		run := a.newRun()
+		run.backupName = &name
+		if run.withLock("daemon delete-backup "+name, run.DeleteBackup)() != 0 {
+			exitCode = 1
+		} else {
+			a.notify(notification{Event: eventBackupExpired, Backup: name})
+		}
+		if a.interrupted() {
+			return 1
+		}
+	}
+
+	return exitCode
+}
+
+// missedBackup returns true iff no backup completed successfully since the last time one was scheduled to run before
+// now, i.e., more than a whole period of schedule ago
+func (a *app) missedBackup(schedule cron.Schedule, now time.Time) bool {
+	keys, err := a.storage.ListFolder(a.ctx, "")
+	if err != nil {
+		a.logger.Warn("Failed to list backups", zap.Error(err))
+		return false
+	}
+
+	last := int64(0)
+	for _, k := range keys {
+		name := strings.TrimSuffix(k, "/")
+		if isReservedFolder(name) {
+			continue
+		}
+		if completed, err := a.storage.GetLastModifiedTime(a.ctx, a.getSuccessfulMarker(name)); err == nil &&
+			completed > last {
+			last = completed
+		}
+	}
+
+	next := schedule.Next(now)
+	period := schedule.Next(next).Sub(next)
+
+	return time.Unix(last, 0).Add(period).Before(now)
+}
+
+// jitter delays t by a random amount of up to --jitter seconds, so that hosts sharing a schedule don't all hit
+// storage at the same time
+func (a *app) jitter(t time.Time) time.Time {
+	if *a.jitterSeconds <= 0 {
+		return t
+	}
+
+	return t.Add(time.Duration(rand.Int63n(int64(*a.jitterSeconds) * int64(time.Second))))
+}
+
+// serveStatus serves the state of the daemon's jobs as JSON at /status, for health checks; the status is 503 if the
+// last run of any job failed. The control API is served along with it if there's a token to protect it.
+func (a *app) serveStatus(state *daemonState) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		jobs := state.snapshot()
+		status := http.StatusOK
+		for _, j := range jobs {
+			if j.LastExitCode != 0 {
+				status = http.StatusServiceUnavailable
+			}
+		}
+		body, err := json.Marshal(jobs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(body)
+	})
+	if *a.apiToken != "" {
+		a.registerAPI(mux, state)
+	}
+	server := &http.Server{Addr: *a.statusAddress, Handler: mux}
+
+	go func() {
+		<-a.ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	a.logger.Info("Serving status", zap.String("address", *a.statusAddress))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		a.logger.Error("Failed to serve status", zap.Error(err))
+	}
+}
+
+func parseDaemonArgs(cfg *app, parser *argparse.Command) {
+	cfg.backupSchedule = parser.String(
+		"",
+		"backup-schedule",
+		&argparse.Options{
+			Required: false,
+			Default:  cfg.config.stringValue("backup-schedule", "0 2 * * *"),
+			Help:     "Cron expression (minute hour day month weekday, or e.g. @daily) for when to create backups"})
+	cfg.retentionSchedule = parser.String(
+		"",
+		"retention-schedule",
+		&argparse.Options{
+			Required: false,
+			Default:  cfg.config.stringValue("retention-schedule", "0 4 * * *"),
+			Help:     "Cron expression for when to delete backups beyond --retain"})
+	cfg.retain = parser.Int(
+		"",
+		"retain",
+		&argparse.Options{
+			Required: false,
+			Default:  cfg.config.intValue("retain", 0),
+			Help:     "Number of successful backups to keep (0 keeps them all)"})
+	cfg.jitterSeconds = parser.Int(
+		"",
+		"jitter",
+		&argparse.Options{
+			Required: false,
+			Default:  cfg.config.intValue("jitter", 0),
+			Help:     "Delay each scheduled run by a random number of seconds, up to the given one"})
+	cfg.noCatchUp = cfg.config.flag(
+		parser,
+		"no-catch-up",
+		"Do not take a backup on start when the last scheduled one was missed")
+	cfg.statusAddress = parser.String(
+		"",
+		"status-listen",
+		&argparse.Options{
+			Required: false,
+			Default:  cfg.config.stringValue("status-listen", "localhost:9716"),
+			Help:     "Address to serve the status of the scheduled jobs (at /status) and the API on (empty to disable)"})
+	cfg.apiToken = parser.String(
+		"",
+		"api-token",
+		&argparse.Options{
+			Required: false,
+			Default:  cfg.config.stringValue("api-token", ""),
+			Help: "Serve the control API, which requires this bearer token (prefer PGCARPENTER_API_TOKEN or the " +
+				"configuration file, which ps does not show)"})
+}
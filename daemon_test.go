@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestExpireBackups(t *testing.T) {
+	s := newMemoryStorage()
+	nWorkers, lockWait, retain := 1, 0, 1
+	notifyCommand, notifyURL := "", ""
+	a := &app{ctx: context.Background(), logger: zap.NewNop(), storage: s, runState: &runState{}}
+	a.nWorkers, a.lockWait, a.retain = &nWorkers, &lockWait, &retain
+	a.notifyCommand, a.notifyURL = &notifyCommand, &notifyURL
+
+	// two successful backups, the oldest of which expires, and aborted ones older than the one kept
+	for name, completed := range map[string]int64{"old": 100, "new": 200} {
+		s.PutString(a.ctx, name+"/", "")
+		s.PutString(a.ctx, name+"/PG_VERSION", "15")
+		s.PutString(a.ctx, a.getSuccessfulMarker(name), "")
+		s.mtimes[a.getSuccessfulMarker(name)] = completed
+	}
+	for _, name := range []string{"interrupted", "unknown"} {
+		s.PutString(a.ctx, name+"/", "")
+		s.mtimes[name+"/"] = 50
+		s.PutString(a.ctx, a.getAbortedMarker(name), "")
+	}
+	// we can't tell when this one started
+	s.failures["unknown/"] = errors.New("connection reset by peer")
+
+	if exitCode := a.expireBackups(); exitCode != 0 {
+		t.Fatalf("unexpected exit code %d", exitCode)
+	}
+	for key, kept := range map[string]bool{
+		"new/PG_VERSION": true, "old/PG_VERSION": false, "interrupted/": false, a.getAbortedMarker("unknown"): true,
+	} {
+		if _, ok := s.objects[key]; ok != kept {
+			t.Errorf("%s: expected kept to be %v", key, kept)
+		}
+	}
+}
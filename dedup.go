@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/thumbtack/pgCarpenter/storage"
+	"github.com/thumbtack/pgCarpenter/util"
+	"go.uber.org/zap"
+)
+
+// content-addressed storage shared by all backups created with --deduplicate
+const objectsFolder = "objects"
+
+// objects are spread across 256 "folders" named after the first byte of the hash to keep listings manageable
+func (a *app) getContentAddressedKey(hash string, extension string) string {
+	return filepath.Join(objectsFolder, hash[:2], hash+extension)
+}
+
+// putContentAddressed uploads the contents of the local file path to the objects folder, unless an object with the
+// same contents is already there. The file must not change while this function runs, i.e., it must be a temporary
+// copy of the original one. It returns the key of the object, and whether it was actually uploaded.
+func (a *app) putContentAddressed(path string, extension string, mtime int64) (string, bool, error) {
+	hash, err := util.HashFile(path)
+	if err != nil {
+		return "", false, err
+	}
+
+	key := a.getContentAddressedKey(hash, extension)
+	// some other backup already uploaded this exact content
+	if _, err := a.storage.GetLastModifiedTime(a.ctx, key); err == nil {
+		a.logger.Debug("Object already exists", zap.String("key", key))
+		return key, false, nil
+	}
+
+	if err := a.storage.Put(a.ctx, key, path, mtime); err != nil {
+		return "", false, err
+	}
+
+	return key, true, nil
+}
+
+// collectGarbage removes all objects from the content-addressed storage that are not referenced by the
+// manifest of any backup (mark-and-sweep)
+func (a *app) collectGarbage() error {
+	a.logger.Info("Collecting garbage from the objects folder")
+
+	// mark
+	referenced, err := a.referencedObjects()
+	if err != nil {
+		return err
+	}
+	// a nil set means there's a deduplicated backup in progress, which references objects we know nothing about
+	if referenced == nil {
+		return nil
+	}
+
+	// sweep
+	keysC := make(chan string)
+	wg := &sync.WaitGroup{}
+	wg.Add(*a.nWorkers)
+	for i := 0; i < *a.nWorkers; i++ {
+		go a.garbageWorker(keysC, referenced, wg)
+	}
+
+	if err := a.storage.WalkFolder(a.ctx, objectsFolder+"/", keysC); err != nil {
+		close(keysC)
+		wg.Wait()
+		return err
+	}
+
+	close(keysC)
+	wg.Wait()
+
+	return nil
+}
+
+// return the set of keys of all objects referenced by the manifest of at least one backup
+func (a *app) referencedObjects() (map[string]bool, error) {
+	allBackups, err := a.storage.ListFolder(a.ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]bool)
+	for _, k := range allBackups {
+		backupName := strings.TrimSuffix(k, "/")
+		if isReservedFolder(backupName) {
+			continue
+		}
+
+		m, err := a.getManifest(backupName)
+		if errors.Is(err, storage.ErrNotFound) {
+			// backups without a manifest were not deduplicated and do not reference any object
+			a.logger.Debug("No manifest found", zap.String("backup", backupName))
+			continue
+		}
+		if err != nil {
+			// we can't tell which objects the backup references, so none of them can be deleted
+			return nil, fmt.Errorf("failed to read the manifest of backup %s: %w", backupName, err)
+		}
+
+		if m.Deduplicated && !m.Complete && !m.Aborted {
+			a.logger.Warn(
+				"Found an incomplete deduplicated backup, skipping garbage collection "+
+					"(delete the backup if it is no longer running)",
+				zap.String("backup", backupName))
+			return nil, nil
+		}
+
+		for _, f := range m.Files {
+			if strings.HasPrefix(f.Key, objectsFolder+"/") {
+				referenced[f.Key] = true
+			}
+		}
+	}
+
+	return referenced, nil
+}
+
+func (a *app) garbageWorker(keysC <-chan string, referenced map[string]bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		key, more := <-keysC
+		if !more {
+			return
+		}
+		// once asked to stop, just drain the channel
+		if a.interrupted() {
+			continue
+		}
+
+		if referenced[key] {
+			continue
+		}
+
+		a.logger.Debug("Deleting unreferenced object", zap.String("key", key))
+		if err := a.storage.Delete(a.ctx, key); err != nil {
+			a.fail("Failed to delete object", key, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// dedupApp returns an app whose storage holds the deduplicated backups complete (referencing objects a and b) and
+// interrupted (referencing c), a backup without a manifest, and the objects a to d
+func dedupApp(t *testing.T) (*app, *memoryStorage) {
+	s := newMemoryStorage()
+	nWorkers := 2
+	a := &app{
+		ctx:      context.Background(),
+		logger:   zap.NewNop(),
+		storage:  s,
+		runState: &runState{},
+	}
+	a.nWorkers = &nWorkers
+
+	backups := map[string]*manifest{
+		"complete": {Deduplicated: true, Complete: true, Files: []manifestEntry{
+			{Path: "base/1/1", Key: "objects/aa/a"},
+			{Path: "base/1/2", Key: "objects/bb/b"},
+			{Path: "base/1", Directory: true},
+		}},
+		"interrupted": {Deduplicated: true, Aborted: true, Files: []manifestEntry{
+			{Path: "base/1/3", Key: "objects/cc/c"},
+		}},
+	}
+	for name, m := range backups {
+		if err := a.putManifest(name, m); err != nil {
+			t.Fatal(err)
+		}
+		s.PutString(a.ctx, name+"/", "")
+	}
+	s.PutString(a.ctx, "legacy/PG_VERSION", "15")
+	for _, key := range []string{"objects/aa/a", "objects/bb/b", "objects/cc/c", "objects/dd/d"} {
+		s.PutString(a.ctx, key, key)
+	}
+
+	return a, s
+}
+
+func TestReferencedObjects(t *testing.T) {
+	a, _ := dedupApp(t)
+
+	referenced, err := a.referencedObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{"objects/aa/a": true, "objects/bb/b": true, "objects/cc/c": true}
+	if !reflect.DeepEqual(referenced, expected) {
+		t.Errorf("expected %v, got %v", expected, referenced)
+	}
+}
+
+func TestReferencedObjectsIncompleteBackup(t *testing.T) {
+	a, _ := dedupApp(t)
+	if err := a.putManifest("running", &manifest{Deduplicated: true}); err != nil {
+		t.Fatal(err)
+	}
+	a.storage.PutString(a.ctx, "running/", "")
+
+	referenced, err := a.referencedObjects()
+	if err != nil || referenced != nil {
+		t.Errorf("expected no objects and no error, got %v, %v", referenced, err)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	a, s := dedupApp(t)
+
+	if err := a.collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"objects/aa/a", "objects/bb/b", "objects/cc/c"} {
+		if _, ok := s.objects[key]; !ok {
+			t.Errorf("referenced object %s deleted", key)
+		}
+	}
+	if _, ok := s.objects["objects/dd/d"]; ok {
+		t.Error("unreferenced object objects/dd/d not deleted")
+	}
+}
+
+func TestCollectGarbageUnreadableManifest(t *testing.T) {
+	for name, failure := range map[string]func(s *memoryStorage){
+		"read error": func(s *memoryStorage) {
+			s.failures[manifestsFolder+"/complete"] = errors.New("connection reset by peer")
+		},
+		"invalid manifest": func(s *memoryStorage) {
+			s.objects[manifestsFolder+"/complete"] = []byte("{")
+		},
+	} {
+		a, s := dedupApp(t)
+		failure(s)
+
+		if err := a.collectGarbage(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		for _, key := range []string{"objects/aa/a", "objects/bb/b", "objects/cc/c", "objects/dd/d"} {
+			if _, ok := s.objects[key]; !ok {
+				t.Errorf("%s: object %s deleted", name, key)
+			}
+		}
+	}
+}
@@ -14,20 +14,30 @@ func (a *app) DeleteBackup() int {
 	begin := time.Now()
 
 	// make sure the backup exists
-	_, err := a.storage.GetString(*a.backupName + "/")
+	_, err := a.storage.GetString(a.ctx, *a.backupName+"/")
 	if err != nil {
 		a.logger.Error("Backup not found", zap.String("name", *a.backupName), zap.Error(err))
 		return 1
 	}
 
+	// deduplicated backups keep their files in the objects folder, which may need garbage collection
+	deduplicated := false
+	if m, err := a.getManifest(*a.backupName); err == nil {
+		deduplicated = m.Deduplicated
+	}
+
 	// traverse the backup directory and delete all objects
-	if err := a.traverseAndDelete(); err != nil {
+	if err := a.traverseAndDelete(); err != nil && !a.interrupted() {
 		a.logger.Error("Failed to traverse backup folder", zap.Error(err))
 		return 1
 	}
+	// keep the backup around (and listed) until all of its objects are gone, so that deleting it can be retried
+	if a.failed() > 0 || a.interrupted() {
+		return a.reportFailures("Delete")
+	}
 
 	// remove the top level folder
-	if err := a.storage.Delete(*a.backupName + "/"); err != nil {
+	if err := a.storage.Delete(a.ctx, *a.backupName+"/"); err != nil {
 		a.logger.Error("Failed to delete the top level folder", zap.Error(err))
 		return 1
 	}
@@ -37,9 +47,31 @@ func (a *app) DeleteBackup() int {
 		a.logger.Error("Failed to delete successful marker", zap.Error(err))
 	}
 
+	// remove the aborted marker, if one exists
+	if err := a.deleteAbortedMarker(*a.backupName); err != nil {
+		a.logger.Error("Failed to delete aborted marker", zap.Error(err))
+	}
+
+	// remove the manifest, if one exists; this must happen after the successful marker is gone so that
+	// a backup is never marked as successful without a manifest
+	if err := a.deleteManifest(*a.backupName); err != nil {
+		a.logger.Error("Failed to delete manifest", zap.Error(err))
+	}
+
 	// update the reference to LATEST
 	a.updateReferenceToLatest()
 
+	// remove objects no other backup references
+	if deduplicated {
+		if err := a.collectGarbage(); err != nil {
+			a.logger.Error("Failed to collect garbage", zap.Error(err))
+			return 1
+		}
+		if a.failed() > 0 {
+			return a.reportFailures("Garbage collection")
+		}
+	}
+
 	a.logger.Info(
 		"Backup successfully deleted",
 		zap.Duration("seconds", time.Now().Sub(begin)),
@@ -61,16 +93,14 @@ func (a *app) traverseAndDelete() error {
 	}
 
 	// kick off the (recursive) listing of all objects and storing their path in the keysC channel
-	if err := a.storage.WalkFolder(*a.backupName+"/", keysC); err != nil {
-		return err
-	}
+	err := a.storage.WalkFolder(a.ctx, *a.backupName+"/", keysC)
 
 	// close the channel to signal there are no more items and wait for all workers to finish
 	a.logger.Info("Waiting for all workers to finish")
 	close(keysC)
 	wg.Wait()
 
-	return nil
+	return err
 }
 
 func (a *app) deleteWorker(keysC <-chan string, wg *sync.WaitGroup) {
@@ -84,10 +114,14 @@ func (a *app) deleteWorker(keysC <-chan string, wg *sync.WaitGroup) {
 			a.logger.Debug("No more files to delete")
 			return
 		}
+		// once asked to stop, just drain the channel
+		if a.interrupted() {
+			continue
+		}
 
 		a.logger.Debug("Deleting file", zap.String("key", key))
-		if err := a.storage.Delete(key); err != nil {
-			a.logger.Error("Failed to delete file", zap.String("key", key))
+		if err := a.storage.Delete(a.ctx, key); err != nil {
+			a.fail("Failed to delete file", key, err)
 		}
 	}
 }
@@ -107,7 +141,7 @@ func (a *app) updateReferenceToLatest() {
 	}
 
 	// fetch all allBackups at the root of the bucket
-	allBackups, err := a.storage.ListFolder("")
+	allBackups, err := a.storage.ListFolder(a.ctx, "")
 	if err != nil {
 		a.logger.Error("Failed to get all backups", zap.Error(err))
 	}
@@ -116,9 +150,9 @@ func (a *app) updateReferenceToLatest() {
 	newLatestKey := ""
 	newLatestMTime := int64(0)
 	for _, bkp := range allBackups {
-		mtime, err := a.storage.GetLastModifiedTime(bkp)
+		mtime, err := a.storage.GetLastModifiedTime(a.ctx, bkp)
 		if err == nil {
-			_, err = a.storage.GetString(a.getSuccessfulMarker(bkp))
+			_, err = a.storage.GetString(a.ctx, a.getSuccessfulMarker(bkp))
 			if err == nil {
 				if mtime > newLatestMTime {
 					a.logger.Debug(
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/thumbtack/pgCarpenter/util"
+	"go.uber.org/zap"
+)
+
+// removeExtraneousFiles compares the data directory to the manifest of the backup being restored and removes every
+// file and directory not in the backup, e.g., dropped relations or temporary files left behind by a crash; left in
+// place, these could corrupt the cluster after recovery. Entries whose type differs from the backup's (e.g., a
+// directory where the backup has a file) are removed as well, so they can be restored.
+//
+// directories the data directory links to, like tablespaces or pg_wal, are cleaned up too; the links themselves are
+// kept as long as the backup has a directory with the same name
+func (a *app) removeExtraneousFiles(m *manifest) error {
+	if m == nil {
+		return errors.New("delta restore requires a backup with a manifest")
+	}
+
+	entries := make(map[string]manifestEntry, len(m.Files))
+	for _, e := range m.Files {
+		entries[e.Path] = e
+	}
+	// the restore state file is not part of the backup, but must survive
+	keep := make(map[string]bool)
+	if a.restored != nil {
+		if rel, err := filepath.Rel(*a.pgDataDirectory, a.restored.path); err == nil {
+			keep[rel] = true
+		}
+	}
+
+	removed, err := a.removeExtraneousFilesFrom(*a.pgDataDirectory, entries, keep)
+	a.logger.Info("Removed files not in the backup", zap.Int("files", removed))
+
+	return err
+}
+
+// traverse the directory rooted at root (which must end with a slash so that symlinks are followed), removing what is
+// not in entries; return the number of files and directories removed
+func (a *app) removeExtraneousFilesFrom(
+	root string,
+	entries map[string]manifestEntry,
+	keep map[string]bool,
+) (int, error) {
+	removed := 0
+	err := filepath.Walk(
+		root,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if path == root {
+				return nil
+			}
+
+			file := strings.TrimPrefix(path, *a.pgDataDirectory)
+			if keep[file] {
+				return nil
+			}
+
+			e, ok := entries[file]
+			isLink := info.Mode()&os.ModeSymlink != 0
+			isDir := info.IsDir()
+			if isLink {
+				// what matters is what the link points to
+				if st, err := os.Stat(path); err == nil {
+					isDir = st.IsDir()
+				}
+			}
+
+			if !ok || e.Directory != isDir {
+				a.logger.Debug("Removing file not in the backup", zap.String("path", file))
+				removed++
+				// for links, only the link itself is removed
+				if err := os.RemoveAll(path); err != nil {
+					return err
+				}
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if isLink && isDir {
+				n, err := a.removeExtraneousFilesFrom(path+"/", entries, keep)
+				removed += n
+				return err
+			}
+
+			return nil
+		},
+	)
+
+	return removed, err
+}
+
+// deltaUnchanged returns true iff the local file at path already has the contents of the backup's entry: same size
+// and, if the backup recorded it, the same checksum; otherwise the same mtime
+func (a *app) deltaUnchanged(path string, entry manifestEntry) bool {
+	st, err := os.Stat(path)
+	if err != nil || !st.Mode().IsRegular() || st.Size() != entry.Size {
+		return false
+	}
+
+	if entry.Checksum == "" {
+		return entry.MTime != 0 && st.ModTime().Unix() == entry.MTime
+	}
+
+	checksum, err := util.HashFile(path)
+	if err != nil {
+		a.logger.Error("Failed to compute checksum", zap.String("path", path), zap.Error(err))
+		return false
+	}
+
+	return checksum == entry.Checksum
+}
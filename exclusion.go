@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// the rules below follow the ones pg_basebackup uses (see src/backend/replication/basebackup.c)
+
+// directories, relative to the data directory, whose contents are not backed up; the directories themselves are,
+// as PG expects them to exist
+var excludeDirContents = []string{
+	"pg_stat_tmp",
+	"pg_replslot",
+	"pg_dynshmem",
+	"pg_notify",
+	"pg_serial",
+	"pg_snapshots",
+	"pg_subtrans",
+}
+
+// files that are not backed up, regardless of the directory they're in
+var excludeFiles = []string{
+	"postmaster.pid",
+	"postmaster.opts",
+	// belong to an exclusive backup started by the user; ours are stored when the backup is stopped
+	"backup_label",
+	"tablespace_map",
+}
+
+// same as excludeFiles, but only from the given server version onwards
+var excludeFilesSince = map[string]int{
+	"current_logfiles": 100000,
+	"backup_manifest":  130000,
+}
+
+// files in the root of the data directory that make a standby a standby; backups taken from one must not include
+// them, otherwise restoring it would start yet another standby of the original primary
+var standbyFiles = []string{"standby.signal", "recovery.signal"}
+
+// before PG 12 the recovery configuration lived in its own file
+var standbyFilesBefore12 = []string{"recovery.conf"}
+
+const (
+	// relation cache init files are rebuilt on startup
+	relCacheInitPrefix = "pg_internal.init"
+	// temporary files and directories created by queries
+	tempFilesPrefix = "pgsql_tmp"
+)
+
+var (
+	// relation files, e.g., 16384, 16384_fsm, 16384.1
+	relationFileRE = regexp.MustCompile(`^([0-9]+)(_(fsm|vm|init))?(\.[0-9]+)?$`)
+	// temporary relation files, e.g., t3_16384
+	tempRelationFileRE = regexp.MustCompile(`^t[0-9]+_[0-9]+(_(fsm|vm|init))?(\.[0-9]+)?$`)
+)
+
+type exclusionRules struct {
+	dataDirectory string
+	serverVersion int
+	standby       bool
+	// shell globs (as in filepath.Match) matched against paths relative to the data directory
+	userPatterns []string
+}
+
+func newExclusionRules(dataDirectory string, serverVersion int, standby bool, userPatterns []string) *exclusionRules {
+	return &exclusionRules{
+		dataDirectory: dataDirectory,
+		serverVersion: serverVersion,
+		standby:       standby,
+		userPatterns:  userPatterns,
+	}
+}
+
+// walDirectory returns the name of the directory PG keeps WAL segments in
+func (r *exclusionRules) walDirectory() string {
+	if r.serverVersion >= 100000 {
+		return "pg_wal"
+	}
+
+	return "pg_xlog"
+}
+
+// excludeContents returns true iff file (relative to the data directory) is a directory that should be backed up
+// without any of its contents
+func (r *exclusionRules) excludeContents(file string) bool {
+	if file == r.walDirectory() {
+		return true
+	}
+
+	for _, d := range excludeDirContents {
+		if file == d {
+			return true
+		}
+	}
+
+	return false
+}
+
+// excludeFile returns true iff file (relative to the data directory) should not be backed up at all
+func (r *exclusionRules) excludeFile(file string, info os.FileInfo) bool {
+	name := filepath.Base(file)
+
+	for _, f := range excludeFiles {
+		if name == f {
+			return true
+		}
+	}
+
+	if since, ok := excludeFilesSince[name]; ok && r.serverVersion >= since {
+		return true
+	}
+
+	if r.standby {
+		files := standbyFiles
+		if r.serverVersion < 120000 {
+			files = standbyFilesBefore12
+		}
+		for _, f := range files {
+			if file == f {
+				return true
+			}
+		}
+	}
+
+	if strings.HasPrefix(name, relCacheInitPrefix) || strings.HasPrefix(name, tempFilesPrefix) {
+		return true
+	}
+
+	if !info.IsDir() && isRelationDirectory(filepath.Dir(file)) {
+		if tempRelationFileRE.MatchString(name) {
+			return true
+		}
+		// unlogged relations are reset to their init fork on startup; only the init fork needs to be backed up
+		if m := relationFileRE.FindStringSubmatch(name); m != nil && m[3] != "init" {
+			initFork := filepath.Join(r.dataDirectory, filepath.Dir(file), m[1]+"_init")
+			if _, err := os.Stat(initFork); err == nil {
+				return true
+			}
+		}
+	}
+
+	return r.matchesUserPattern(file)
+}
+
+// matchesUserPattern returns true iff file (relative to the data directory) matches one of the --exclude patterns
+func (r *exclusionRules) matchesUserPattern(file string) bool {
+	for _, p := range r.userPatterns {
+		if match, err := filepath.Match(p, file); err == nil && match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requiredDirectories returns the directories that must exist in a restored data directory in order for PG to
+// start; they may be missing from backups that were taken by older versions of pgCarpenter
+func (r *exclusionRules) requiredDirectories() []string {
+	dirs := append([]string{tablespacesDirectory, "pg_stat"}, excludeDirContents...)
+	if r.serverVersion > 0 {
+		dirs = append(dirs, r.walDirectory(), filepath.Join(r.walDirectory(), "archive_status"))
+	}
+
+	return dirs
+}
+
+// return true iff dir (relative to the data directory) holds the relation files of a database, i.e., it is either
+// base/<OID> or pg_tblspc/<OID>/<version directory>/<OID>
+func isRelationDirectory(dir string) bool {
+	parts := strings.Split(dir, string(filepath.Separator))
+	switch {
+	case len(parts) == 2 && parts[0] == "base":
+		return true
+	case len(parts) == 4 && parts[0] == tablespacesDirectory:
+		return true
+	}
+
+	return false
+}
+
+// validateExcludePattern makes sure the argument of --exclude is a valid shell glob
+func validateExcludePattern(args []string) error {
+	if _, err := filepath.Match(args[0], ""); err != nil {
+		return errors.New("invalid exclude pattern: " + args[0])
+	}
+
+	return nil
+}
+
+// readServerVersion parses the PG_VERSION file of the data directory dataDir (e.g., "9.6" or "12") into the
+// equivalent of server_version_num (e.g., 90600 or 120000)
+func readServerVersion(dataDir string) (int, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(dataDir, "PG_VERSION"))
+	if err != nil {
+		return 0, err
+	}
+
+	return parseServerVersion(strings.TrimSpace(string(contents)))
+}
+
+// parseServerVersion converts a version string (e.g., "9.6.24", "12", or "16beta1") into the major version part of
+// server_version_num (e.g., 90600, 120000, or 160000)
+func parseServerVersion(version string) (int, error) {
+	parts := strings.SplitN(version, ".", 3)
+	major, err := strconv.Atoi(leadingDigits(parts[0]))
+	if err != nil {
+		return 0, errors.New("invalid server version: " + version)
+	}
+	if major >= 10 {
+		return major * 10000, nil
+	}
+
+	minor := 0
+	if len(parts) >= 2 {
+		if minor, err = strconv.Atoi(leadingDigits(parts[1])); err != nil {
+			return 0, errors.New("invalid server version: " + version)
+		}
+	}
+
+	return major*10000 + minor*100, nil
+}
+
+func leadingDigits(s string) string {
+	for i, c := range s {
+		if c < '0' || c > '9' {
+			return s[:i]
+		}
+	}
+
+	return s
+}
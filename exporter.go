@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/pierrec/lz4"
+	"go.uber.org/zap"
+)
+
+const (
+	metricsPrefix = "pgcarpenter_"
+	// how long to wait for PG when collecting the WAL archive lag
+	metricsQueryTimeout = 10 * time.Second
+)
+
+// the name of a WAL segment, as opposed to that of a history or partial file
+var walSegmentRE = regexp.MustCompile(`^[0-9A-F]{24}$`)
+
+// metricFamily is a set of samples of the same metric, in the Prometheus text exposition format
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	samples []string
+}
+
+// metrics collects metric families, keeping them in the order they were first added
+type metrics struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+func newMetrics() *metrics {
+	return &metrics{byName: make(map[string]*metricFamily)}
+}
+
+// add a sample of metric name; labels are given as name/value pairs
+func (m *metrics) add(name string, kind string, help string, value float64, labels ...string) {
+	f, ok := m.byName[name]
+	if !ok {
+		f = &metricFamily{name: metricsPrefix + name, help: help, kind: kind}
+		m.families = append(m.families, f)
+		m.byName[name] = f
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	sample := f.name
+	if len(pairs) > 0 {
+		sample += "{" + strings.Join(pairs, ",") + "}"
+	}
+	f.samples = append(f.samples, fmt.Sprintf("%s %g", sample, value))
+}
+
+func (m *metrics) gauge(name string, help string, value float64, labels ...string) {
+	m.add(name, "gauge", help, value, labels...)
+}
+
+func (m *metrics) String() string {
+	b := &strings.Builder{}
+	for _, f := range m.families {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, s := range f.samples {
+			b.WriteString(s + "\n")
+		}
+	}
+
+	return b.String()
+}
+
+// exporter exposes metrics on the health of the archive, read from storage: either once, to a file for the textfile
+// collector of the node exporter (e.g., from cron), or continuously over HTTP
+func (a *app) exporter() int {
+	if *a.metricsFile != "" {
+		if err := writeFileAtomically(*a.metricsFile, a.collectMetrics().String()); err != nil {
+			a.logger.Error("Failed to write metrics", zap.String("path", *a.metricsFile), zap.Error(err))
+			return 1
+		}
+		return 0
+	}
+
+	// listing every backup and WAL segment is too expensive to do on every scrape, so it's done in the background
+	var mutex sync.Mutex
+	current := a.collectMetrics().String()
+	go func() {
+		ticker := time.NewTicker(time.Duration(*a.metricsInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-ticker.C:
+				m := a.collectMetrics().String()
+				mutex.Lock()
+				current = m
+				mutex.Unlock()
+			}
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		body := current
+		mutex.Unlock()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, body)
+	})
+	server := &http.Server{Addr: *a.listenAddress, Handler: mux}
+
+	go func() {
+		<-a.ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	a.logger.Info("Serving metrics", zap.String("address", *a.listenAddress))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		a.logger.Error("Failed to serve metrics", zap.Error(err))
+		return 1
+	}
+
+	return 0
+}
+
+// collectMetrics reads the state of the archive from storage (and, if asked to, the current WAL position from PG);
+// errors are logged and counted, and the metrics that could not be collected are left out
+func (a *app) collectMetrics() *metrics {
+	begin := time.Now()
+	m := newMetrics()
+	errs := make(map[string]int)
+
+	if err := a.collectBackupMetrics(m); err != nil {
+		a.logger.Error("Failed to collect backup metrics", zap.Error(err))
+		errs["backups"]++
+	}
+
+	lastSegment, err := a.collectWALMetrics(m)
+	if err != nil {
+		a.logger.Error("Failed to collect WAL metrics", zap.Error(err))
+		errs["wal"]++
+	}
+
+	if *a.walLag && lastSegment != "" {
+		if err := a.collectWALLagMetrics(m, lastSegment); err != nil {
+			a.logger.Error("Failed to collect WAL archive lag", zap.Error(err))
+			errs["wal_lag"]++
+		}
+	}
+
+	for _, op := range []string{"backups", "wal", "wal_lag"} {
+		m.gauge("collect_errors", "Errors collecting metrics, by operation", float64(errs[op]), "operation", op)
+	}
+	m.gauge("collect_duration_seconds", "Time spent collecting metrics", time.Since(begin).Seconds())
+
+	return m
+}
+
+// collectBackupMetrics adds the status of each backup and, for those with a manifest, their sizes and durations
+func (a *app) collectBackupMetrics(m *metrics) error {
+	keys, err := a.storage.ListFolder(a.ctx, "")
+	if err != nil {
+		return err
+	}
+
+	counts := map[string]int{"successful": 0, "incomplete": 0, "aborted": 0}
+	lastSuccessful := int64(0)
+	for _, k := range keys {
+		backupName := strings.TrimSuffix(k, "/")
+		if isReservedFolder(backupName) {
+			continue
+		}
+
+		// the successful marker is created when the backup completes
+		status := "successful"
+		completed, err := a.storage.GetLastModifiedTime(a.ctx, a.getSuccessfulMarker(backupName))
+		if err != nil {
+			status = "incomplete"
+			if _, err := a.storage.GetString(a.ctx, a.getAbortedMarker(backupName)); err == nil {
+				status = "aborted"
+			}
+		} else if completed > lastSuccessful {
+			lastSuccessful = completed
+		}
+		counts[status]++
+
+		// backups created by older versions do not have a manifest
+		bm, err := a.getManifest(backupName)
+		if err != nil {
+			a.logger.Debug("No manifest found", zap.String("backup", backupName), zap.Error(err))
+			continue
+		}
+		m.gauge("backup_size_bytes", "Total size of the files of a backup, before compression",
+			float64(bm.size()), "backup", backupName, "status", status)
+		m.gauge("backup_uploaded_bytes", "Bytes uploaded by a backup, after compression and deduplication",
+			float64(bm.UploadedBytes), "backup", backupName, "status", status)
+		m.gauge("backup_files", "Number of files and directories in a backup",
+			float64(len(bm.Files)), "backup", backupName, "status", status)
+		m.gauge("backup_failures", "Files that could not be uploaded by an aborted backup",
+			float64(bm.Failures), "backup", backupName, "status", status)
+		m.gauge("backup_checksum_failures", "Pages that failed checksum verification during a backup",
+			float64(bm.checksumFailures()), "backup", backupName, "status", status)
+		if bm.EndTime > 0 {
+			m.gauge("backup_duration_seconds", "Time it took to complete a backup",
+				float64(bm.EndTime-bm.StartTime), "backup", backupName, "status", status)
+		}
+	}
+
+	for _, status := range []string{"successful", "incomplete", "aborted"} {
+		m.gauge("backups", "Number of backups, by status", float64(counts[status]), "status", status)
+	}
+	if lastSuccessful > 0 {
+		m.gauge("last_successful_backup_timestamp_seconds", "When the most recent successful backup completed",
+			float64(lastSuccessful))
+		m.gauge("last_successful_backup_age_seconds", "Time since the most recent successful backup completed",
+			float64(time.Now().Unix()-lastSuccessful))
+	}
+
+	return nil
+}
+
+// collectWALMetrics adds the number of archived WAL segments and when the newest one was archived; it returns the
+// name of the latter
+func (a *app) collectWALMetrics(m *metrics) (string, error) {
+	keysC := make(chan string)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- a.storage.WalkFolder(a.ctx, walFolder+"/", keysC)
+		close(keysC)
+	}()
+
+	segments := make([]string, 0)
+	for key := range keysC {
+		name := strings.TrimSuffix(filepath.Base(key), lz4.Extension)
+		if walSegmentRE.MatchString(name) {
+			segments = append(segments, name)
+		}
+	}
+	if err := <-errC; err != nil {
+		return "", err
+	}
+
+	m.gauge("archived_wal_segments", "Number of WAL segments in the archive", float64(len(segments)))
+	if len(segments) == 0 {
+		return "", nil
+	}
+
+	// the names of WAL segments sort in the order they were written, across timelines
+	sort.Strings(segments)
+	last := segments[len(segments)-1]
+	mtime, err := a.storage.GetLastModifiedTime(a.ctx, a.getWALObjectKey(last))
+	if err != nil {
+		return last, err
+	}
+	m.gauge("last_archived_wal_timestamp_seconds", "When the newest WAL segment was archived", float64(mtime))
+	m.gauge("last_archived_wal_age_seconds", "Time since the newest WAL segment was archived",
+		float64(time.Now().Unix()-mtime))
+
+	return last, nil
+}
+
+// collectWALLagMetrics adds the number of bytes of WAL written (or replayed, on a standby) by PG after the end of
+// lastSegment, the newest archived segment
+func (a *app) collectWALLagMetrics(m *metrics, lastSegment string) error {
+	connStr, err := a.connInfo()
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(a.ctx, metricsQueryTimeout)
+	defer cancel()
+
+	var serverVersion int
+	if err := db.QueryRowContext(ctx, "SHOW server_version_num").Scan(&serverVersion); err != nil {
+		return err
+	}
+	// the xlog functions were renamed to wal in PG 10
+	query := "SELECT CASE WHEN pg_is_in_recovery() THEN pg_last_wal_replay_lsn() ELSE pg_current_wal_lsn() END"
+	if serverVersion < 100000 {
+		query = "SELECT CASE WHEN pg_is_in_recovery() THEN pg_last_xlog_replay_location() " +
+			"ELSE pg_current_xlog_location() END"
+	}
+	var current string
+	if err := db.QueryRowContext(ctx, query).Scan(&current); err != nil {
+		return err
+	}
+	currentLSN, err := parseLSN(current)
+	if err != nil {
+		return err
+	}
+
+	var setting string
+	if err := db.QueryRowContext(ctx, "SHOW wal_segment_size").Scan(&setting); err != nil {
+		return err
+	}
+	segmentSize, err := parseSize(setting)
+	if err != nil {
+		return err
+	}
+
+	segment, err := walSegmentNumber(lastSegment, segmentSize)
+	if err != nil {
+		return err
+	}
+	lag := int64(currentLSN) - int64((segment+1)*segmentSize)
+	if lag < 0 {
+		lag = 0
+	}
+	m.gauge("wal_archive_lag_bytes", "Bytes of WAL written after the end of the newest archived segment",
+		float64(lag))
+
+	return nil
+}
+
+// write contents to path, so that readers never see a partially written file
+func writeFileAtomically(path string, contents string) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(contents), 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+func parseExporterArgs(cfg *app, parser *argparse.Command) {
+	cfg.listenAddress = parser.String(
+		"",
+		"listen",
+		&argparse.Options{
+			Required: false,
+			Default:  cfg.config.stringValue("listen", ":9715"),
+			Help:     "Address to serve metrics on, at /metrics"})
+	cfg.metricsInterval = parser.Int(
+		"",
+		"interval",
+		&argparse.Options{
+			Required: false,
+			Default:  cfg.config.intValue("interval", 60),
+			Help:     "Number of seconds between collections of metrics when serving them"})
+	cfg.metricsFile = parser.String(
+		"",
+		"textfile",
+		&argparse.Options{
+			Required: false,
+			Default:  cfg.config.stringValue("textfile", ""),
+			Help:     "Write the metrics once to the given file (for the node exporter's textfile collector) and exit"})
+	cfg.walLag = cfg.config.flag(
+		parser,
+		"wal-lag",
+		"Connect to PostgreSQL to report how far behind the WAL archive is")
+}
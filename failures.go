@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// how many errors are included in the summary of a failed command
+const maxReportedFailures = 10
+
+// failureLog collects the errors of the workers of a command. Workers log each error and carry on with the next
+// item; the command then checks the log and fails with a summary of what went wrong.
+type failureLog struct {
+	mutex  sync.Mutex
+	count  int
+	errors []string
+}
+
+// fail logs an error encountered while processing path and records it in the failure log
+func (a *app) fail(msg string, path string, err error) {
+	// once asked to stop, everything in progress fails; there's no point in reporting each one
+	if a.interrupted() {
+		a.logger.Debug(msg, zap.String("path", path), zap.Error(err))
+	} else {
+		a.logger.Error(msg, zap.String("path", path), zap.Error(err))
+	}
+
+	a.failures.mutex.Lock()
+	defer a.failures.mutex.Unlock()
+
+	a.failures.count++
+	if len(a.failures.errors) < maxReportedFailures {
+		a.failures.errors = append(a.failures.errors, msg+": "+path+": "+err.Error())
+	}
+}
+
+// failed returns the number of errors recorded so far
+func (a *app) failed() int {
+	a.failures.mutex.Lock()
+	defer a.failures.mutex.Unlock()
+
+	return a.failures.count
+}
+
+// reportFailures logs a summary of the errors recorded, if any, and returns the exit code of the command
+func (a *app) reportFailures(command string) int {
+	a.failures.mutex.Lock()
+	defer a.failures.mutex.Unlock()
+
+	if a.interrupted() {
+		a.logger.Warn(command + " interrupted")
+		return 1
+	}
+	if a.failures.count == 0 {
+		return 0
+	}
+
+	a.logger.Error(
+		command+" failed",
+		zap.Int("errors", a.failures.count),
+		zap.Strings("first_errors", a.failures.errors))
+
+	return 1
+}
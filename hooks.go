@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// how long a post hook may take; they run even if the command was interrupted, so they can't rely on its context
+const postHookTimeout = 5 * time.Minute
+
+// runHook runs the user's command for hook (e.g., pre-backup) with a shell, if there's one. Its output is logged, and
+// it gets the details of the backup in the environment:
+//
+//	PGCARPENTER_HOOK            the name of the hook
+//	PGCARPENTER_BACKUP          the name of the backup
+//	PGCARPENTER_DATA_DIRECTORY  the data directory being backed up or restored into
+//	PGCARPENTER_START_LSN       where the backup starts, once known
+//	PGCARPENTER_STOP_LSN        where the backup ends, once known
+//	PGCARPENTER_STATUS          for post hooks, "success" or "failure"
+func (a *app) runHook(ctx context.Context, hook string, command string, status string) error {
+	if command == "" {
+		return nil
+	}
+	a.logger.Info("Running hook", zap.String("hook", hook), zap.String("command", command))
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(
+		os.Environ(),
+		envPrefix+"HOOK="+hook,
+		envPrefix+"BACKUP="+*a.backupName,
+		envPrefix+"DATA_DIRECTORY="+*a.pgDataDirectory,
+		envPrefix+"START_LSN="+a.startLSN,
+		envPrefix+"STOP_LSN="+a.stopLSN,
+		envPrefix+"STATUS="+status)
+	out, err := cmd.CombinedOutput()
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		a.logger.Info("Hook output", zap.String("hook", hook), zap.String("line", scanner.Text()))
+	}
+
+	return err
+}
+
+// runPostHook runs the user's command for hook after an operation that ended with exitCode, even if it was
+// interrupted (e.g., to undo whatever the pre hook did); a failing post hook is logged, but does not change the
+// outcome of the operation, which is complete by then
+func (a *app) runPostHook(hook string, command string, exitCode int) {
+	status := "success"
+	if exitCode != 0 {
+		status = "failure"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), postHookTimeout)
+	defer cancel()
+	if err := a.runHook(ctx, hook, command, status); err != nil {
+		a.logger.Error("Hook failed", zap.String("hook", hook), zap.Error(err))
+	}
+}
@@ -9,67 +9,95 @@ import (
 	"go.uber.org/zap"
 )
 
+// backupEntry is the summary of a backup shown by list-backups
+type backupEntry struct {
+	Name       string `json:"name"`
+	Timestamp  int64  `json:"timestamp"`
+	Successful bool   `json:"successful"`
+	Aborted    bool   `json:"aborted"`
+	Latest     bool   `json:"latest"`
+}
+
 func (a *app) listBackups() int {
-	type backupEntry struct {
-		name       string
-		timestamp  int64
-		successful bool
+	format := "%-34s%-28s%s"
+
+	backups, err := a.getBackups()
+	if err != nil {
+		a.logger.Error("Failed to list backups", zap.Error(err))
 	}
 
-	format := "%-34s%-28s%s"
+	// formatted output
+	fmt.Printf(format, "Name", "Created", "\n")
+	for _, b := range backups {
+		fmt.Printf(format, b.Name, formatTime(b.Timestamp), formatStatus(b.Successful, b.Aborted))
+		endLine := ""
+		if b.Latest {
+			endLine = "(LATEST)"
+		}
+		fmt.Println(endLine)
+	}
+
+	return 0
+}
+
+// getBackups returns all backups, oldest first
+func (a *app) getBackups() ([]backupEntry, error) {
 	backups := make([]backupEntry, 0)
 
 	// fetch all keys at the root of the bucket
-	keys, err := a.storage.ListFolder("")
+	keys, err := a.storage.ListFolder(a.ctx, "")
 	if err != nil {
-		a.logger.Error("Failed to list backups", zap.Error(err))
+		return backups, err
 	}
+	latest := a.getLatest()
 
 	for _, k := range keys {
 		// remove the trailing slash from the backup's name
 		backupName := k[:len(k)-1]
-		// ignore the folder used to mark successful backups and the one we keep WAL segments in
-		if backupName == successfullyCompletedFolder || backupName == walFolder {
+		// ignore the folders used to mark successful backups, keep WAL segments, manifests, and deduplicated objects
+		if isReservedFolder(backupName) {
 			continue
 		}
 
-		bkp := backupEntry{name: backupName, timestamp: 0}
-		// try to get the object's last modified timestamp
-		mtime, err := a.storage.GetLastModifiedTime(k)
-		if err == nil {
-			bkp.timestamp = mtime
-		}
+		backups = append(backups, a.getBackup(backupName, latest))
+	}
+
+	// sort by timestamp asc
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Timestamp < backups[j].Timestamp
+	})
 
-		// was this backup successfully completed?
-		_, err = a.storage.GetString(a.getSuccessfulMarker(backupName))
-		bkp.successful = err == nil
+	return backups, nil
+}
 
-		backups = append(backups, bkp)
+// getBackup returns the summary of backupName; latest is the name of the latest backup
+func (a *app) getBackup(backupName string, latest string) backupEntry {
+	bkp := backupEntry{Name: backupName, Timestamp: 0, Latest: backupName == latest}
+	// try to get the object's last modified timestamp
+	mtime, err := a.storage.GetLastModifiedTime(a.ctx, backupName+"/")
+	if err == nil {
+		bkp.Timestamp = mtime
 	}
 
-	// try to get the name of the latest backup
-	latest, err := a.storage.GetString(latestKey)
-	if err != nil {
-		latest = ""
+	// was this backup successfully completed?
+	_, err = a.storage.GetString(a.ctx, a.getSuccessfulMarker(backupName))
+	bkp.Successful = err == nil
+	if !bkp.Successful {
+		_, err = a.storage.GetString(a.ctx, a.getAbortedMarker(backupName))
+		bkp.Aborted = err == nil
 	}
 
-	// sort by timestamp asc
-	sort.Slice(backups, func(i, j int) bool {
-		return backups[i].timestamp < backups[j].timestamp
-	})
+	return bkp
+}
 
-	// formatted output
-	fmt.Printf(format, "Name", "Created", "\n")
-	for _, b := range backups {
-		fmt.Printf(format, b.name, formatTime(b.timestamp), formatStatus(b.successful))
-		endLine := ""
-		if b.name == latest {
-			endLine = "(LATEST)"
-		}
-		fmt.Println(endLine)
+// getLatest returns the name of the latest backup, or an empty string if there's none
+func (a *app) getLatest() string {
+	latest, err := a.storage.GetString(a.ctx, latestKey)
+	if err != nil {
+		return ""
 	}
 
-	return 0
+	return latest
 }
 
 func formatTime(mtime int64) string {
@@ -78,7 +106,10 @@ func formatTime(mtime int64) string {
 	return t.Format(time.RFC3339)
 }
 
-func formatStatus(success bool) string {
+func formatStatus(success bool, aborted bool) string {
+	if aborted {
+		return "(aborted!) "
+	}
 	if !success {
 		return "(incomplete!) "
 	}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/thumbtack/pgCarpenter/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	// object holding the lease of the command currently allowed to modify the archive
+	lockKey = "LOCK"
+	// a lease not renewed for this long is considered abandoned, e.g., its holder was killed
+	lockLeaseDuration = 5 * time.Minute
+	lockRenewInterval = time.Minute
+	// how often to check whether the lock was released, when waiting for it
+	lockPollInterval = 10 * time.Second
+	// object storage has no compare-and-swap, so after taking the lock we wait a bit and read it back to make sure
+	// no one else took it at the same time (the last write wins)
+	lockSettleDelay = 2 * time.Second
+	// reading the lock is retried this many times, lockRetryDelay apart, before giving up
+	lockReadAttempts = 3
+	lockRetryDelay   = 5 * time.Second
+)
+
+// lease is the content of the lock object
+type lease struct {
+	Owner   string `json:"owner"`
+	Host    string `json:"host"`
+	PID     int    `json:"pid"`
+	Token   string `json:"token"`
+	Expires int64  `json:"expires"`
+}
+
+func (l *lease) String() string {
+	return fmt.Sprintf("%s (host %s, pid %d, expires %s)", l.Owner, l.Host, l.PID, formatTime(l.Expires))
+}
+
+// withLock returns a callback that runs command while holding the lock on the archive, so that commands that create
+// or delete backups (and move LATEST around) never interleave. If the lock is lost while command runs, e.g., the
+// lease expired because renewing it kept failing, command is stopped as if interrupted.
+func (a *app) withLock(owner string, command func() int) func() int {
+	return func() int {
+		l, err := a.acquireLock(owner)
+		if err != nil {
+			a.logger.Error("Failed to acquire the lock", zap.Error(err))
+			return 1
+		}
+
+		parent := a.ctx
+		ctx, cancel := context.WithCancel(parent)
+		defer cancel()
+		a.ctx = ctx
+		defer func() { a.ctx = parent }()
+
+		lost := int32(0)
+		stopRenewing := a.renewLock(ctx, l, func() {
+			atomic.StoreInt32(&lost, 1)
+			cancel()
+		})
+		defer a.releaseLock(l)
+		defer stopRenewing()
+
+		exitCode := command()
+		if atomic.LoadInt32(&lost) == 1 {
+			return 1
+		}
+
+		return exitCode
+	}
+}
+
+// acquireLock takes the lock, waiting for up to --wait seconds for its current holder to release it (or for its
+// lease to expire)
+func (a *app) acquireLock(owner string) (*lease, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	l := &lease{Owner: owner, Host: host, PID: os.Getpid(), Token: hex.EncodeToString(token)}
+
+	deadline := time.Now().Add(time.Duration(*a.lockWait) * time.Second)
+	for {
+		current, err := a.getLock(a.ctx)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil || current.Expires <= time.Now().Unix() {
+			if current != nil {
+				a.logger.Warn("Taking over an expired lock", zap.Stringer("holder", current))
+			}
+			if err := a.putLock(l); err != nil {
+				return nil, err
+			}
+			if err := a.sleep(lockSettleDelay); err != nil {
+				return nil, err
+			}
+			current, err = a.getLock(a.ctx)
+			if err != nil {
+				return nil, err
+			}
+			if current != nil && current.Token == l.Token {
+				a.logger.Debug("Acquired the lock", zap.Stringer("lease", l))
+				return l, nil
+			}
+			// someone else was faster
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("the archive is locked by " + current.String())
+		}
+		a.logger.Info("Waiting for the lock", zap.Stringer("holder", current))
+		if err := a.sleep(lockPollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// renewLock extends the lease of l every lockRenewInterval, until the returned function is called. If someone else
+// holds the lock, or the lease expires before it could be renewed, lost is called and renewing stops.
+func (a *app) renewLock(ctx context.Context, l *lease, lost func()) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(lockRenewInterval)
+		defer ticker.Stop()
+		expires := l.Expires
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current, err := a.getLock(ctx)
+			if err == nil && (current == nil || current.Token != l.Token) {
+				a.logger.Error("Lost the lock, stopping", zap.Stringer("holder", current))
+				lost()
+				return
+			}
+			if err == nil {
+				err = a.putLock(l)
+			}
+			if err == nil {
+				expires = l.Expires
+				continue
+			}
+
+			// not fatal as long as the next attempt may still succeed before the lease expires
+			if time.Now().Add(lockRenewInterval).Unix() >= expires {
+				a.logger.Error("Failed to renew the lock before it expired, stopping", zap.Error(err))
+				lost()
+				return
+			}
+			a.logger.Warn("Failed to renew the lock", zap.Error(err))
+		}
+	}()
+
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+// releaseLock deletes the lock object, unless someone else holds it by now
+func (a *app) releaseLock(l *lease) {
+	// the context of the command may be canceled already, but the lock must be released regardless
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+
+	current, err := a.getLock(ctx)
+	if err != nil {
+		a.logger.Error("Failed to release the lock", zap.Error(err))
+		return
+	}
+	if current == nil || current.Token != l.Token {
+		a.logger.Warn("The lock is no longer ours, not releasing it", zap.Stringer("holder", current))
+		return
+	}
+	if err := a.storage.Delete(ctx, lockKey); err != nil {
+		a.logger.Error("Failed to release the lock", zap.Error(err))
+	}
+}
+
+// return the current lease, or nil if the archive is not locked; failing to read the lock is retried, and is an
+// error rather than a reason to assume it's not there
+func (a *app) getLock(ctx context.Context) (*lease, error) {
+	var body string
+	var err error
+	for attempt := 1; ; attempt++ {
+		body, err = a.storage.GetString(ctx, lockKey)
+		if err == storage.ErrNotFound {
+			return nil, nil
+		}
+		if err == nil || attempt == lockReadAttempts || ctx.Err() != nil {
+			break
+		}
+		a.logger.Warn("Failed to read the lock, retrying", zap.Error(err))
+		select {
+		case <-ctx.Done():
+		case <-time.After(lockRetryDelay):
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the lock: %v", err)
+	}
+
+	l := &lease{}
+	if err := json.Unmarshal([]byte(body), l); err != nil {
+		a.logger.Warn("Ignoring invalid lock", zap.String("body", body), zap.Error(err))
+		return nil, nil
+	}
+
+	return l, nil
+}
+
+// save l in the lock object, with a fresh expiry
+func (a *app) putLock(l *lease) error {
+	l.Expires = time.Now().Add(lockLeaseDuration).Unix()
+	body, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	return a.storage.PutString(a.ctx, lockKey, string(body))
+}
+
+// sleep for d, unless asked to stop first
+func (a *app) sleep(d time.Duration) error {
+	select {
+	case <-a.ctx.Done():
+		return a.ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// breakLock deletes the lock regardless of who holds it; it's meant for operators recovering from a command that
+// died without releasing it and whose lease they don't want to wait out
+func (a *app) breakLock() int {
+	current, err := a.getLock(a.ctx)
+	if err != nil {
+		a.logger.Error("Failed to check the lock", zap.Error(err))
+		return 1
+	}
+	if current == nil {
+		a.logger.Info("The archive is not locked")
+		return 0
+	}
+
+	a.logger.Warn("Breaking the lock", zap.Stringer("holder", current))
+	if err := a.storage.Delete(a.ctx, lockKey); err != nil {
+		a.logger.Error("Failed to delete the lock", zap.Error(err))
+		return 1
+	}
+
+	return 0
+}
+
+func parseBreakLockArgs(cfg *app, parser *argparse.Command) {
+	// there are no options as of now, we just keep this around for consistency
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sync"
 
 	"github.com/akamensky/argparse"
 	"github.com/thumbtack/pgCarpenter/storage"
 	"github.com/thumbtack/pgCarpenter/storage/s3storage"
+	"github.com/thumbtack/pgCarpenter/throttle"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -17,6 +20,7 @@ import (
 const (
 	walFolder                   = "WAL"
 	successfullyCompletedFolder = "successful"
+	abortedFolder               = "aborted"
 	latestKey                   = "LATEST"
 	backupNameRE                = "^[a-zA-Z0-9_-]+$"
 )
@@ -26,6 +30,7 @@ var gitCommit string
 
 type app struct {
 	// common
+	configFile      *string
 	s3Region        *string
 	s3Bucket        *string
 	s3MaxRetries    *int
@@ -34,21 +39,105 @@ type app struct {
 	nWorkers        *int    // only create, restore, and delete can effectively use > 1
 	walPath         *string // only required by archive-wal and restore-wal
 	tmpDirectory    *string
-	verbose         *bool
-	// set on create_backup.go
-	pgUser            *string
-	pgPassword        *string
-	sslMode           *string
-	backupCheckpoint  *bool
-	statementTimeout  *int
-	compressThreshold *int
+	lockWait        *int // only create and delete take the lock
+	maxUploadRate   *string
+	maxDownloadRate *string
+	maxReadRate     *string // only create-backup reads the data directory
+	// notifications, see notify.go
+	notifyCommand         *string
+	notifyURL             *string
+	notifyEvents          *[]string
+	notifyArchiveFailures *int
+	verbose               *bool
+	// only required by create-backup and stream-wal
+	pgConnInfo *string
+	pgHost     *string
+	pgPort     *int
+	pgDatabase *string
+	pgUser     *string
+	pgPassword *string
+	sslMode    *string
+	// set on create_backup.go, for either create-backup or daemon
+	backupOptions
 	// set on restore_backup.go
-	modifiedOnly *bool
+	modifiedOnly       *bool
+	delta              *bool
+	force              *bool
+	owner              *string
+	tablespaceMap      *[]string
+	restoreStateFile   *string
+	preRestoreCommand  *string
+	postRestoreCommand *string
 	// set on restore_wal.go
 	walFileName *string
+	// set on stream_wal.go
+	slotName        *string
+	createSlot      *bool
+	statusInterval  *int
+	partialInterval *int
+	// set on exporter.go
+	listenAddress   *string
+	metricsInterval *int
+	metricsFile     *string
+	walLag          *bool
+	// set on daemon.go
+	backupSchedule    *string
+	retentionSchedule *string
+	retain            *int
+	jitterSeconds     *int
+	noCatchUp         *bool
+	statusAddress     *string
+	apiToken          *string
 	// internal
+	ctx     context.Context
+	config  *config
 	storage storage.Storage
 	logger  *zap.Logger
+	// limits the rate at which files in the data directory are read; nil if unlimited
+	readLimiter *throttle.Limiter
+	*runState
+}
+
+// runState is what a command keeps track of while it runs; every job the daemon runs gets a fresh one, see newRun
+type runState struct {
+	manifest *manifest
+	failures failureLog
+	errors   errorRecorder
+	// set by startProgress, see currentProgress
+	progress      *progress
+	progressMutex sync.Mutex
+	// set on create_backup.go when resuming an interrupted backup
+	resumed *resumeState
+	// set on restore_backup.go
+	restored     *restoreState
+	restoreOwner *fileOwner
+	// set on create_backup.go and stream_wal.go
+	serverVersion  int
+	startLSN       string
+	stopLSN        string
+	walSegmentSize uint64
+	exclusions     *exclusionRules
+	// set on create_backup.go, when page checksums are to be verified
+	dataChecksums bool
+	blockSize     int
+	startLSNValue uint64
+}
+
+// newRun returns a copy of a with a fresh runState, logging through a logger that records errors in it
+func (a *app) newRun() *app {
+	run := *a
+	run.runState = &runState{}
+	run.logger = recordErrors(a.logger, &run.errors)
+
+	return &run
+}
+
+// recordErrors returns a logger that logs through logger, keeping track of the errors logged in recorder (e.g., to
+// include them in notifications)
+func recordErrors(logger *zap.Logger, recorder *errorRecorder) *zap.Logger {
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(core, recorder.core())
+	}))
 }
 
 func initLogging() (*zap.Logger, *zap.AtomicLevel) {
@@ -72,26 +161,38 @@ func parseArgs(a *app) func() int {
 		"pgCarpenter",
 		"PostgreSQL Continuous Archiving and Point-in-Time Recovery")
 
+	// settings from the environment and the configuration file become the defaults of the flags below
+	a.config = loadConfig(os.Args[1:])
+
 	// flags common to all sub-commands
+	a.configFile = parser.String(
+		"",
+		"config",
+		&argparse.Options{
+			Required: false,
+			Default:  a.config.path,
+			Help: "YAML file with default values for the flags, keyed by their long names; PGCARPENTER_* environment " +
+				"variables (e.g., PGCARPENTER_PASSWORD) take precedence over it"})
 	a.s3Region = parser.String(
 		"",
 		"s3-region",
 		&argparse.Options{
 			Required: false,
-			Default:  "us-east-1",
+			Default:  a.config.stringValue("s3-region", "us-east-1"),
 			Help:     "AWS region where the S3 bucket lives in"})
 	a.s3Bucket = parser.String(
 		"",
 		"s3-bucket",
 		&argparse.Options{
-			Required: len(os.Args) > 1 && os.Args[1] != "version",
+			Required: len(os.Args) > 1 && os.Args[1] != "version" && !a.config.has("s3-bucket"),
+			Default:  a.config.stringValue("s3-bucket", ""),
 			Help:     "S3 bucket where to push/fetch backups to/from"})
 	a.s3MaxRetries = parser.Int(
 		"",
 		"s3-max-retries",
 		&argparse.Options{
 			Required: false,
-			Default:  3,
+			Default:  a.config.intValue("s3-max-retries", 3),
 			Help:     "Maximum number of attempts at connecting to S3"})
 	a.backupName = parser.String(
 		"",
@@ -105,30 +206,90 @@ func parseArgs(a *app) func() int {
 		"",
 		"data-directory",
 		&argparse.Options{
-			Required: len(os.Args) > 1 && (os.Args[1] == "create-backup" || os.Args[1] == "restore-backup"),
+			Required: false,
 			Validate: validateDataDirectory,
+			Default:  a.config.stringValue("data-directory", ""),
 			Help:     "Full path to the data directory of the PostgreSQL cluster to backup"})
 	a.nWorkers = parser.Int(
 		"",
 		"workers",
 		&argparse.Options{
 			Required: false,
-			Default:  1,
+			Default:  a.config.intValue("workers", 1),
 			Help:     "Number of concurrent jobs"})
 	a.tmpDirectory = parser.String(
 		"",
 		"tmp",
 		&argparse.Options{
 			Required: false,
-			Default:  "/tmp",
+			Default:  a.config.stringValue("tmp", "/tmp"),
 			Help:     "Directory to use for creating temporary files"})
-	a.verbose = parser.Flag(
+	a.lockWait = parser.Int(
 		"",
-		"verbose",
+		"wait",
+		&argparse.Options{
+			Required: false,
+			Default:  a.config.intValue("wait", 0),
+			Help:     "Number of seconds to wait for another backup or delete running on the same bucket to finish"})
+	a.maxUploadRate = parser.String(
+		"",
+		"max-upload-rate",
+		&argparse.Options{
+			Required: false,
+			Default:  a.config.stringValue("max-upload-rate", ""),
+			Validate: validateRate,
+			Help:     "Maximum number of bytes per second to upload, across all workers (e.g., 50MB)"})
+	a.maxDownloadRate = parser.String(
+		"",
+		"max-download-rate",
+		&argparse.Options{
+			Required: false,
+			Default:  a.config.stringValue("max-download-rate", ""),
+			Validate: validateRate,
+			Help:     "Maximum number of bytes per second to download, across all workers (e.g., 50MB)"})
+	a.maxReadRate = parser.String(
+		"",
+		"max-read-rate",
+		&argparse.Options{
+			Required: false,
+			Default:  a.config.stringValue("max-read-rate", ""),
+			Validate: validateRate,
+			Help:     "Maximum number of bytes per second to read from the data directory, across all workers"})
+	a.notifyCommand = parser.String(
+		"",
+		"notify-command",
+		&argparse.Options{
+			Required: false,
+			Default:  a.config.stringValue("notify-command", ""),
+			Help: "Shell command to run on backup, restore, archiving and expiry events, with a JSON description of " +
+				"the event on stdin and PGCARPENTER_EVENT and PGCARPENTER_BACKUP in the environment"})
+	a.notifyURL = parser.String(
+		"",
+		"notify-url",
+		&argparse.Options{
+			Required: false,
+			Default:  a.config.stringValue("notify-url", ""),
+			Help:     "URL to POST a JSON description of backup, restore, archiving and expiry events to"})
+	a.notifyEvents = parser.List(
+		"",
+		"notify-event",
+		&argparse.Options{
+			Required: false,
+			Default:  a.config.listValue("notify-event", nil),
+			Help: "Only notify about the given event (may be repeated): backup_started, backup_succeeded, " +
+				"backup_failed, restore_succeeded, restore_failed, archive_wal_failing, archive_wal_recovered, " +
+				"backup_expired"})
+	a.notifyArchiveFailures = parser.Int(
+		"",
+		"notify-archive-failures",
 		&argparse.Options{
 			Required: false,
-			Default:  false,
-			Help:     "Verbose output"})
+			Default:  a.config.intValue("notify-archive-failures", 3),
+			Help:     "Notify when archive-wal fails this many times in a row (0 to never notify)"})
+	a.verbose = a.config.flag(
+		parser.Command,
+		"verbose",
+		"Verbose output")
 	// archive WAL + restore WAL
 	a.walPath = parser.String(
 		"",
@@ -136,20 +297,81 @@ func parseArgs(a *app) func() int {
 		&argparse.Options{
 			Required: len(os.Args) > 1 && (os.Args[1] == "archive-wal" || os.Args[1] == "restore-wal"),
 			Help:     "Path to the WAL segment"})
+	// create-backup + stream-wal
+	a.pgConnInfo = parser.String(
+		"",
+		"conninfo",
+		&argparse.Options{
+			Required: false,
+			Default:  a.config.stringValue("conninfo", ""),
+			Help:     "libpq connection string (keyword/value or URI); other connection flags take precedence"})
+	a.pgHost = parser.String(
+		"",
+		"host",
+		&argparse.Options{
+			Required: false,
+			Default:  a.config.stringValue("host", ""),
+			Help:     "PostgreSQL host name or Unix socket directory"})
+	a.pgPort = parser.Int(
+		"",
+		"port",
+		&argparse.Options{
+			Required: false,
+			Default:  a.config.intValue("port", 0),
+			Help:     "PostgreSQL port"})
+	a.pgDatabase = parser.String(
+		"",
+		"dbname",
+		&argparse.Options{
+			Required: false,
+			Default:  a.config.stringValue("dbname", ""),
+			Help:     "Database to connect to"})
+	a.pgUser = parser.String(
+		"",
+		"user",
+		&argparse.Options{
+			Required: false,
+			Default:  a.config.stringValue("user", ""),
+			Help:     "PostgreSQL user (defaults to PGUSER or postgres)"})
+	a.pgPassword = parser.String(
+		"",
+		"password",
+		&argparse.Options{
+			Required: false,
+			Default:  a.config.stringValue("password", ""),
+			Help:     "PostgreSQL password (prefer PGCARPENTER_PASSWORD or the configuration file, which ps does not show)"})
+	a.sslMode = parser.Selector(
+		"",
+		"sslmode",
+		[]string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"},
+		&argparse.Options{
+			Required: false,
+			Default:  a.config.stringValue("sslmode", ""),
+			Help:     "SSL certificate verification mode (defaults to PGSSLMODE or disable)"})
 
 	// subcommands
 	listBackupsCmd := parser.NewCommand("list-backups", "List all available backups")
 	parseListBackupsArgs(a, listBackupsCmd)
 	createBackupCmd := parser.NewCommand("create-backup", "Create a new base backup")
-	parseCreateBackupArgs(a, createBackupCmd)
+	createBackupOptions := parseCreateBackupArgs(a, createBackupCmd)
+	daemonCmd := parser.NewCommand("daemon", "Create and expire backups on a schedule")
+	parseDaemonArgs(a, daemonCmd)
+	// the daemon creates backups with the same options as create-backup
+	daemonBackupOptions := parseCreateBackupArgs(a, daemonCmd)
 	restoreBackupCmd := parser.NewCommand("restore-backup", "Restore a base backup")
 	parseRestoreBackupArgs(a, restoreBackupCmd)
 	archiveWALCmd := parser.NewCommand("archive-wal", "Archive a WAL segment (use with archive_command)")
 	parseArchiveWALArgs(a, archiveWALCmd)
 	restoreWALCmd := parser.NewCommand("restore-wal", "Restore a WAL segment (use with restore_command)")
 	parseRestoreWALArgs(a, restoreWALCmd)
+	streamWALCmd := parser.NewCommand("stream-wal", "Continuously stream WAL from a replication slot and archive it")
+	parseStreamWALArgs(a, streamWALCmd)
 	deleteBackupCmd := parser.NewCommand("delete-backup", "Delete a base backup")
 	parseDeleteBackupArgs(a, deleteBackupCmd)
+	exporterCmd := parser.NewCommand("exporter", "Expose Prometheus metrics on the backups and the WAL archive")
+	parseExporterArgs(a, exporterCmd)
+	breakLockCmd := parser.NewCommand("break-lock", "Release the lock held by a backup or delete that died")
+	parseBreakLockArgs(a, breakLockCmd)
 	versionCmd := parser.NewCommand("version", "Print the version of pgCarpenter")
 
 	// parse input
@@ -161,6 +383,30 @@ func parseArgs(a *app) func() int {
 		// essentially a no-op
 		return func() int { return 1 }
 	}
+	a.config.applyNegations()
+	a.backupOptions = createBackupOptions
+	if daemonCmd.Happened() {
+		a.backupOptions = daemonBackupOptions
+	}
+	// the data directory is required by the commands that read or write it, unless the server sends it
+	if *a.pgDataDirectory == "" && (restoreBackupCmd.Happened() ||
+		((createBackupCmd.Happened() || daemonCmd.Happened()) && !*a.replication)) {
+		fmt.Print(parser.Usage(errors.New("[--data-directory] is required")))
+		return func() int { return 1 }
+	}
+	// flags are validated by the parser, settings from the environment or the configuration file are not
+	if *a.pgDataDirectory != "" {
+		if err := validateDataDirectory([]string{*a.pgDataDirectory}); err != nil {
+			fmt.Print(parser.Usage(err))
+			return func() int { return 1 }
+		}
+	}
+	if len(a.config.errors) > 0 {
+		for _, err := range a.config.errors {
+			a.logger.Error("Invalid configuration", zap.String("path", a.config.path), zap.Error(err))
+		}
+		return func() int { return 1 }
+	}
 
 	if versionCmd.Happened() {
 		fmt.Printf("pgCarpenter version %s (git: %s)\n", version, gitCommit)
@@ -170,19 +416,31 @@ func parseArgs(a *app) func() int {
 		return a.listBackups
 	}
 	if createBackupCmd.Happened() {
-		return a.createBackup
+		return a.withBackupNotifications(a.withLock("create-backup "+*a.backupName, a.createBackup))
 	}
 	if restoreBackupCmd.Happened() {
-		return a.restoreBackup
+		return a.withRestoreNotifications(a.restoreBackup)
 	}
 	if archiveWALCmd.Happened() {
-		return a.archiveWAL
+		return a.withArchiveNotifications(a.archiveWAL)
 	}
 	if restoreWALCmd.Happened() {
 		return a.restoreWAL
 	}
+	if streamWALCmd.Happened() {
+		return a.streamWAL
+	}
 	if deleteBackupCmd.Happened() {
-		return a.DeleteBackup
+		return a.withLock("delete-backup "+*a.backupName, a.DeleteBackup)
+	}
+	if daemonCmd.Happened() {
+		return a.daemon
+	}
+	if exporterCmd.Happened() {
+		return a.exporter
+	}
+	if breakLockCmd.Happened() {
+		return a.breakLock
 	}
 
 	// we should never reach this point, but the compiler needs it
@@ -203,6 +461,27 @@ func validateDataDirectory(args []string) error {
 	return nil
 }
 
+func validateRate(args []string) error {
+	if _, err := parseSize(args[0]); err != nil {
+		return fmt.Errorf("invalid rate ('%s'), expected a number of bytes optionally followed by kB, MB or GB", args[0])
+	}
+
+	return nil
+}
+
+// rateLimiter returns a limiter for the rate given as a PG memory size (e.g., 50MB), or nil if there's none
+func rateLimiter(rate string) (*throttle.Limiter, error) {
+	if rate == "" {
+		return nil, nil
+	}
+	bytesPerSecond, err := parseSize(rate)
+	if err != nil {
+		return nil, err
+	}
+
+	return throttle.New(int64(bytesPerSecond)), nil
+}
+
 func validateBackupName(args []string) error {
 	// make sure the backup name is valid
 	errorMsg := fmt.Sprintf("backup name ('%s') does not match '%s'", args[0], backupNameRE)
@@ -216,6 +495,17 @@ func validateBackupName(args []string) error {
 	return nil
 }
 
+// isReservedFolder returns true iff name is one of the top level folders pgCarpenter uses for its own
+// bookkeeping, i.e., it's not the name of a backup
+func isReservedFolder(name string) bool {
+	switch name {
+	case walFolder, successfullyCompletedFolder, abortedFolder, manifestsFolder, objectsFolder:
+		return true
+	}
+
+	return false
+}
+
 // make sure we have the absolute path to the data directory
 func (a *app) normalizeDataDirectoryPath() error {
 	// get the absolute path
@@ -243,9 +533,18 @@ func main() {
 	// flush the buffer before exiting
 	defer logger.Sync()
 
+	// canceled when we're asked to stop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	cfg := &app{
-		logger: logger,
+		ctx:      ctx,
+		logger:   logger,
+		runState: &runState{},
 	}
+	go cfg.handleSignals(cancel)
+	// keep track of the errors logged, to include them in notifications
+	cfg.logger = recordErrors(logger, &cfg.errors)
 
 	// parse the command line arguments and get a callback to the subcommand we should execute
 	callback := parseArgs(cfg)
@@ -255,8 +554,31 @@ func main() {
 		atom.SetLevel(zap.DebugLevel)
 	}
 
+	// throttling, shared by all workers
+	uploadLimiter, err := rateLimiter(*cfg.maxUploadRate)
+	if err != nil {
+		cfg.logger.Error("Invalid upload rate", zap.Error(err))
+		os.Exit(1)
+	}
+	downloadLimiter, err := rateLimiter(*cfg.maxDownloadRate)
+	if err != nil {
+		cfg.logger.Error("Invalid download rate", zap.Error(err))
+		os.Exit(1)
+	}
+	cfg.readLimiter, err = rateLimiter(*cfg.maxReadRate)
+	if err != nil {
+		cfg.logger.Error("Invalid read rate", zap.Error(err))
+		os.Exit(1)
+	}
+
 	// as of now the only supported storage backend is S3
-	cfg.storage = s3storage.New(*cfg.s3Bucket, *cfg.s3Region, *cfg.s3MaxRetries, cfg.logger)
+	cfg.storage = s3storage.New(
+		*cfg.s3Bucket,
+		*cfg.s3Region,
+		*cfg.s3MaxRetries,
+		uploadLimiter,
+		downloadLimiter,
+		cfg.logger)
 
 	// make sure we're using the absolute path to the data directory before starting
 	if err := cfg.normalizeDataDirectoryPath(); err != nil {
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+
+	"github.com/pierrec/lz4"
+	"github.com/thumbtack/pgCarpenter/util"
+)
+
+const (
+	manifestsFolder = "manifests"
+	manifestVersion = 1
+)
+
+// manifestEntry describes a single file or directory of a backup and where its contents are stored
+type manifestEntry struct {
+	// path relative to the data directory
+	Path string `json:"path"`
+	// key of the object holding the contents of the file (empty for directories)
+	Key       string `json:"key,omitempty"`
+	Size      int64  `json:"size"`
+	MTime     int64  `json:"mtime"`
+	Directory bool   `json:"directory,omitempty"`
+	// SHA-256 of the (uncompressed) contents of the file, if known
+	Checksum string `json:"sha256,omitempty"`
+	fileAttributes
+}
+
+// checksumFailure lists the blocks of a relation file that failed page checksum verification
+type checksumFailure struct {
+	Path   string   `json:"path"`
+	Blocks []uint32 `json:"blocks"`
+}
+
+// manifest lists every file and directory included in a backup. Workers add entries concurrently.
+type manifest struct {
+	Version int `json:"version"`
+	// true iff file contents are stored in the content-addressed objects folder
+	Deduplicated bool `json:"deduplicated"`
+	// server_version_num of the cluster the backup was taken from
+	ServerVersion int `json:"server_version"`
+	// when files started being uploaded (Unix time)
+	StartTime int64 `json:"start_time"`
+	// when the backup completed (Unix time)
+	EndTime int64 `json:"end_time,omitempty"`
+	// bytes actually uploaded, after compression, excluding objects that were deduplicated or uploaded by an
+	// interrupted run that was resumed
+	UploadedBytes int64 `json:"uploaded_bytes"`
+	// number of files that could not be uploaded, if the backup was aborted because of them
+	Failures int `json:"failures,omitempty"`
+	// false while the backup is still in progress
+	Complete bool `json:"complete"`
+	// true iff the backup was interrupted; it can be resumed, but is otherwise useless
+	Aborted bool            `json:"aborted,omitempty"`
+	Files   []manifestEntry `json:"files"`
+	// relation files with pages whose checksum did not match when the backup was taken
+	ChecksumFailures []checksumFailure `json:"checksum_failures,omitempty"`
+
+	// index in Files of the entries carried over from an interrupted run, by path, until they are added again
+	seeded map[string]int
+	mutex  sync.Mutex
+}
+
+func newManifest(deduplicated bool) *manifest {
+	return &manifest{
+		Version:      manifestVersion,
+		Deduplicated: deduplicated,
+		Files:        make([]manifestEntry, 0),
+	}
+}
+
+func (m *manifest) add(entry manifestEntry) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if i, ok := m.seeded[entry.Path]; ok {
+		m.Files[i] = entry
+		delete(m.seeded, entry.Path)
+		return
+	}
+	m.Files = append(m.Files, entry)
+}
+
+// seed adds the entries uploaded by an interrupted run of the backup, so that the objects they point to remain
+// referenced (i.e., are not garbage collected) until the files are either reused or uploaded again, which replaces them
+func (m *manifest) seed(entries map[string]manifestEntry) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.seeded = make(map[string]int, len(entries))
+	for path, e := range entries {
+		m.seeded[path] = len(m.Files)
+		m.Files = append(m.Files, e)
+	}
+}
+
+// dropSeeded removes the entries carried over from an interrupted run that were not added again, i.e., of files
+// that no longer exist
+func (m *manifest) dropSeeded() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(m.seeded) == 0 {
+		return
+	}
+	stale := make(map[int]bool, len(m.seeded))
+	for _, i := range m.seeded {
+		stale[i] = true
+	}
+	files := make([]manifestEntry, 0, len(m.Files)-len(stale))
+	for i, e := range m.Files {
+		if !stale[i] {
+			files = append(files, e)
+		}
+	}
+	m.Files = files
+	m.seeded = nil
+}
+
+func (m *manifest) addChecksumFailure(failure checksumFailure) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.ChecksumFailures = append(m.ChecksumFailures, failure)
+}
+
+func (m *manifest) addUploaded(bytes int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.UploadedBytes += bytes
+}
+
+// size returns the total size of the files of the backup, before compression
+func (m *manifest) size() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var size int64
+	for _, f := range m.Files {
+		size += f.Size
+	}
+
+	return size
+}
+
+// checksumFailures returns the total number of blocks that failed page checksum verification
+func (m *manifest) checksumFailures() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	n := 0
+	for _, f := range m.ChecksumFailures {
+		n += len(f.Blocks)
+	}
+
+	return n
+}
+
+func (m *manifest) marshal() (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// compressed returns true iff the object the entry points to is compressed
+func (e manifestEntry) compressed() bool {
+	return e.Key != "" && util.IsObjectCompressed(e.Key)
+}
+
+// entryFromKey creates a manifest entry from the key of an object of a backup that does not have a manifest
+// (i.e., created by an older version of pgCarpenter)
+func entryFromKey(backupName string, key string) manifestEntry {
+	path := key[len(backupName)+1:]
+	if util.IsObjectDirectory(path) {
+		return manifestEntry{Path: path[:len(path)-len(util.DirectoryExtension)], Directory: true}
+	}
+
+	if util.IsObjectCompressed(path) {
+		path = path[:len(path)-len(lz4.Extension)]
+	}
+
+	return manifestEntry{Path: path, Key: key}
+}
+
+func (a *app) getManifestKey(backupName string) string {
+	return filepath.Join(manifestsFolder, backupName)
+}
+
+func (a *app) putManifest(backupName string, m *manifest) error {
+	body, err := m.marshal()
+	if err != nil {
+		return err
+	}
+
+	return a.storage.PutString(a.ctx, a.getManifestKey(backupName), body)
+}
+
+// getManifest fetches and parses the manifest of backupName; backups created by older versions don't have one,
+// in which case storage.ErrNotFound is returned
+func (a *app) getManifest(backupName string) (*manifest, error) {
+	body, err := a.storage.GetString(a.ctx, a.getManifestKey(backupName))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{}
+	if err := json.Unmarshal([]byte(body), m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (a *app) deleteManifest(backupName string) error {
+	key := a.getManifestKey(backupName)
+	_, err := a.storage.GetString(a.ctx, key)
+	if err == nil {
+		if err := a.storage.Delete(a.ctx, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
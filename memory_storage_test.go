@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/thumbtack/pgCarpenter/storage"
+)
+
+// memoryStorage keeps objects, and their last modified time (0 unless set), in memory; reading the keys in failures
+// fails with the given errors
+type memoryStorage struct {
+	mutex    sync.Mutex
+	objects  map[string][]byte
+	mtimes   map[string]int64
+	failures map[string]error
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		objects:  make(map[string][]byte),
+		mtimes:   make(map[string]int64),
+		failures: make(map[string]error),
+	}
+}
+
+func (s *memoryStorage) Put(ctx context.Context, key string, localPath string, mtime int64) error {
+	contents, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+
+	return s.PutString(ctx, key, string(contents))
+}
+
+func (s *memoryStorage) PutReader(ctx context.Context, key string, body io.Reader, mtime int64) error {
+	contents, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	return s.PutString(ctx, key, string(contents))
+}
+
+func (s *memoryStorage) PutString(ctx context.Context, key string, body string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.objects[key] = []byte(body)
+
+	return nil
+}
+
+func (s *memoryStorage) Get(ctx context.Context, key string, out io.WriterAt) error {
+	body, err := s.GetString(ctx, key)
+	if err != nil {
+		return err
+	}
+	_, err = out.WriteAt([]byte(body), 0)
+
+	return err
+}
+
+func (s *memoryStorage) GetString(ctx context.Context, key string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err, ok := s.failures[key]; ok {
+		return "", err
+	}
+	body, ok := s.objects[key]
+	if !ok {
+		return "", storage.ErrNotFound
+	}
+
+	return string(body), nil
+}
+
+func (s *memoryStorage) GetLastModifiedTime(ctx context.Context, key string) (int64, error) {
+	if _, err := s.GetString(ctx, key); err != nil {
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.mtimes[key], nil
+}
+
+// ListFolder returns the folders right below path, like the S3 implementation
+func (s *memoryStorage) ListFolder(ctx context.Context, path string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	folders := make(map[string]bool)
+	for key := range s.objects {
+		if !strings.HasPrefix(key, path) {
+			continue
+		}
+		if i := strings.Index(key[len(path):], "/"); i >= 0 {
+			folders[key[:len(path)+i+1]] = true
+		}
+	}
+
+	keys := make([]string, 0, len(folders))
+	for f := range folders {
+		keys = append(keys, f)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (s *memoryStorage) WalkFolder(ctx context.Context, path string, keysC chan<- string) error {
+	s.mutex.Lock()
+	keys := make([]string, 0)
+	for key := range s.objects {
+		if strings.HasPrefix(key, path) && key != path {
+			keys = append(keys, key)
+		}
+	}
+	s.mutex.Unlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		select {
+		case keysC <- key:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) Delete(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.objects, key)
+
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// how long a notification command or webhook may take
+	notifyTimeout = 30 * time.Second
+	// keeps the number of consecutive archive-wal failures, in the tmp directory
+	archiveFailuresFileName = "pgCarpenter.archive-wal.failures"
+)
+
+// lifecycle events notifications are sent for
+const (
+	eventBackupStarted      = "backup_started"
+	eventBackupSucceeded    = "backup_succeeded"
+	eventBackupFailed       = "backup_failed"
+	eventRestoreSucceeded   = "restore_succeeded"
+	eventRestoreFailed      = "restore_failed"
+	eventArchiveWALFailing  = "archive_wal_failing"
+	eventArchiveWALRecovery = "archive_wal_recovered"
+	eventBackupExpired      = "backup_expired"
+)
+
+// notification is the JSON payload sent to the notification command (on stdin) and webhook
+type notification struct {
+	Event           string   `json:"event"`
+	Time            int64    `json:"time"`
+	Host            string   `json:"host"`
+	Backup          string   `json:"backup,omitempty"`
+	DurationSeconds float64  `json:"duration_seconds,omitempty"`
+	Files           int      `json:"files,omitempty"`
+	Size            int64    `json:"size,omitempty"`
+	UploadedBytes   int64    `json:"uploaded_bytes,omitempty"`
+	Failures        int      `json:"failures,omitempty"`
+	Errors          []string `json:"errors,omitempty"`
+}
+
+// notify runs the notification command and posts to the webhook, if configured and interested in the event; failing
+// to notify is logged but does not affect the outcome of the command
+func (a *app) notify(n notification) {
+	if *a.notifyCommand == "" && *a.notifyURL == "" {
+		return
+	}
+	if len(*a.notifyEvents) > 0 && !contains(*a.notifyEvents, n.Event) {
+		return
+	}
+
+	n.Time = time.Now().Unix()
+	if host, err := os.Hostname(); err == nil {
+		n.Host = host
+	}
+	payload, err := json.Marshal(n)
+	if err != nil {
+		a.logger.Warn("Failed to encode notification", zap.String("event", n.Event), zap.Error(err))
+		return
+	}
+
+	// the command itself may have been interrupted, which is worth notifying about too
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	if *a.notifyCommand != "" {
+		if err := a.runNotifyCommand(ctx, n, payload); err != nil {
+			a.logger.Warn("Notification command failed", zap.String("event", n.Event), zap.Error(err))
+		}
+	}
+	if *a.notifyURL != "" {
+		if err := a.postWebhook(ctx, payload); err != nil {
+			a.logger.Warn("Notification webhook failed", zap.String("event", n.Event), zap.Error(err))
+		}
+	}
+}
+
+// run the notification command with a shell, passing the payload on stdin and the event and backup name in the
+// environment
+func (a *app) runNotifyCommand(ctx context.Context, n notification, payload []byte) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", *a.notifyCommand)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), envPrefix+"EVENT="+n.Event, envPrefix+"BACKUP="+n.Backup)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+func (a *app) postWebhook(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, *a.notifyURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("unexpected response status: " + resp.Status)
+	}
+
+	return nil
+}
+
+// withBackupNotifications returns a callback that runs the backup command, notifying when it starts and how it ends
+func (a *app) withBackupNotifications(command func() int) func() int {
+	return func() int {
+		begin := time.Now()
+		a.notify(notification{Event: eventBackupStarted, Backup: *a.backupName})
+
+		exitCode := command()
+
+		n := notification{
+			Event:           eventBackupSucceeded,
+			Backup:          *a.backupName,
+			DurationSeconds: time.Since(begin).Seconds(),
+		}
+		if a.manifest != nil {
+			n.Files = len(a.manifest.Files)
+			n.Size = a.manifest.size()
+			n.UploadedBytes = a.manifest.UploadedBytes
+		}
+		if exitCode != 0 {
+			n.Event = eventBackupFailed
+			n.Failures = a.failed()
+			n.Errors = a.errors.recent()
+		}
+		a.notify(n)
+
+		return exitCode
+	}
+}
+
+// withRestoreNotifications returns a callback that runs the restore command, notifying how it ends
+func (a *app) withRestoreNotifications(command func() int) func() int {
+	return func() int {
+		begin := time.Now()
+		exitCode := command()
+
+		n := notification{
+			Event:           eventRestoreSucceeded,
+			Backup:          *a.backupName,
+			DurationSeconds: time.Since(begin).Seconds(),
+		}
+		if exitCode != 0 {
+			n.Event = eventRestoreFailed
+			n.Failures = a.failed()
+			n.Errors = a.errors.recent()
+		}
+		a.notify(n)
+
+		return exitCode
+	}
+}
+
+// withArchiveNotifications returns a callback that runs archive-wal, keeping track of consecutive failures: PG retries
+// failed segments forever, so a single failure is not worth notifying about, but --notify-archive-failures in a row
+// are (and so is archiving working again afterwards)
+func (a *app) withArchiveNotifications(command func() int) func() int {
+	return func() int {
+		exitCode := command()
+
+		path := filepath.Join(*a.tmpDirectory, archiveFailuresFileName)
+		failures := 0
+		if contents, err := ioutil.ReadFile(path); err == nil {
+			failures, _ = strconv.Atoi(strings.TrimSpace(string(contents)))
+		}
+
+		if exitCode == 0 {
+			if *a.notifyArchiveFailures > 0 && failures > 0 && failures >= *a.notifyArchiveFailures {
+				a.notify(notification{Event: eventArchiveWALRecovery, Failures: failures})
+			}
+			if failures > 0 {
+				if err := os.Remove(path); err != nil {
+					a.logger.Warn("Failed to reset the archive failure count", zap.Error(err))
+				}
+			}
+			return exitCode
+		}
+
+		failures++
+		if err := ioutil.WriteFile(path, []byte(strconv.Itoa(failures)), 0600); err != nil {
+			a.logger.Warn("Failed to save the archive failure count", zap.Error(err))
+		}
+		// notify once the streak is long enough, and again every time it gets that much longer
+		if *a.notifyArchiveFailures > 0 && failures%*a.notifyArchiveFailures == 0 {
+			a.notify(notification{Event: eventArchiveWALFailing, Failures: failures, Errors: a.errors.recent()})
+		}
+
+		return exitCode
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// how many errors are included in a notification
+const maxRecordedErrors = 10
+
+// errorRecorder is a zap core that keeps the most recent errors logged, so that notifications can include them
+type errorRecorder struct {
+	mutex  sync.Mutex
+	errors []string
+}
+
+// core returns the zap core that records errors into r
+func (r *errorRecorder) core() zapcore.Core {
+	return &recorderCore{recorder: r}
+}
+
+// recent returns the most recent errors logged, oldest first
+func (r *errorRecorder) recent() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]string(nil), r.errors...)
+}
+
+// reset forgets all errors recorded so far
+func (r *errorRecorder) reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.errors = nil
+}
+
+func (r *errorRecorder) record(msg string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.errors = append(r.errors, msg)
+	if len(r.errors) > maxRecordedErrors {
+		r.errors = r.errors[len(r.errors)-maxRecordedErrors:]
+	}
+}
+
+type recorderCore struct {
+	recorder *errorRecorder
+	fields   []zapcore.Field
+}
+
+func (c *recorderCore) Enabled(level zapcore.Level) bool {
+	return level >= zapcore.ErrorLevel
+}
+
+func (c *recorderCore) With(fields []zapcore.Field) zapcore.Core {
+	return &recorderCore{recorder: c.recorder, fields: append(append([]zapcore.Field(nil), c.fields...), fields...)}
+}
+
+func (c *recorderCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+
+	return checked
+}
+
+// Write records the message along with the path and error fields, e.g., "Failed to upload file: base/1/123: timeout"
+func (c *recorderCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range append(c.fields, fields...) {
+		f.AddTo(enc)
+	}
+
+	msg := entry.Message
+	for _, key := range []string{"path", "error"} {
+		if v, ok := enc.Fields[key]; ok {
+			msg += fmt.Sprintf(": %v", v)
+		}
+	}
+	c.recorder.record(msg)
+
+	return nil
+}
+
+func (c *recorderCore) Sync() error {
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/thumbtack/pgCarpenter/util"
+	"go.uber.org/zap"
+)
+
+const (
+	postmasterPIDFile = "postmaster.pid"
+	controlFile       = "global/pg_control"
+)
+
+// checkDataDirectory makes sure restoring into the data directory does not clobber a running cluster or any other
+// data. A data directory that is not empty is only restored into with --delta, --force, or --modified-only (which
+// are meant for that), or to resume an interrupted restore of the same backup, as told by the restore state file. It
+// also warns if the data directory holds a cluster other than the one the backup was taken from.
+func (a *app) checkDataDirectory(m *manifest) error {
+	if err := a.checkPostmasterNotRunning(); err != nil {
+		return err
+	}
+
+	if !*a.delta && !*a.force && !*a.modifiedOnly && !a.resumingRestore(m) {
+		empty, err := isEmptyDirectory(*a.pgDataDirectory)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return errors.New(
+				"the data directory is not empty, use --delta, --force, or --modified-only to restore into it")
+		}
+	}
+
+	a.checkSystemIdentifier(m)
+
+	return nil
+}
+
+// resumingRestore returns true iff the restore state file was left by an interrupted restore of the backup with
+// manifest m; a state file of some other backup (e.g., a stale one) doesn't count
+func (a *app) resumingRestore(m *manifest) bool {
+	fingerprint, err := manifestFingerprint(m)
+	if err != nil {
+		return false
+	}
+
+	return isRestoreStateOf(a.restoreStatePath(), *a.backupName, fingerprint)
+}
+
+// checkPostmasterNotRunning returns an error if postmaster.pid points to a live process
+func (a *app) checkPostmasterNotRunning() error {
+	f, err := os.Open(filepath.Join(*a.pgDataDirectory, postmasterPIDFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// we open this for read only; there's no need to throw an error if closing it fails
+	defer f.Close()
+
+	// the first line is the PID of the postmaster
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || pid <= 0 {
+		a.logger.Warn("Ignoring invalid " + postmasterPIDFile)
+		return nil
+	}
+
+	// signal 0 only checks whether the process exists; EPERM means it does, but belongs to someone else
+	if err := syscall.Kill(pid, 0); err == nil || err == syscall.EPERM {
+		return errors.New("PostgreSQL seems to be running (" + postmasterPIDFile + " points to PID " +
+			strconv.Itoa(pid) + "), stop it before restoring")
+	}
+	a.logger.Warn("Ignoring stale "+postmasterPIDFile, zap.Int("pid", pid))
+
+	return nil
+}
+
+// return true iff the directory path is empty or does not exist
+func isEmptyDirectory(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// we open this for read only; there's no need to throw an error if closing it fails
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+
+	return false, err
+}
+
+// checkSystemIdentifier warns if the data directory has a pg_control with a system identifier other than the one in
+// the backup; it's only a warning since restoring over a different cluster may very well be intended
+func (a *app) checkSystemIdentifier(m *manifest) {
+	local, err := readSystemIdentifier(filepath.Join(*a.pgDataDirectory, controlFile))
+	if err != nil {
+		// nothing to compare to
+		return
+	}
+
+	remote, err := a.backupSystemIdentifier(m)
+	if err != nil {
+		a.logger.Warn("Failed to read the system identifier of the backup", zap.Error(err))
+		return
+	}
+
+	if local != remote {
+		a.logger.Warn(
+			"The data directory belongs to a different cluster than the backup",
+			zap.Uint64("local_system_identifier", local),
+			zap.Uint64("backup_system_identifier", remote))
+	}
+}
+
+// backupSystemIdentifier downloads pg_control from the backup and returns its system identifier
+func (a *app) backupSystemIdentifier(m *manifest) (uint64, error) {
+	// older backups don't have a manifest, but the object is named after the file
+	entry := entryFromKey(*a.backupName, *a.backupName+"/"+controlFile)
+	if m != nil {
+		found := false
+		for _, e := range m.Files {
+			if e.Path == controlFile {
+				entry, found = e, true
+				break
+			}
+		}
+		if !found {
+			return 0, errors.New(controlFile + " not found in backup")
+		}
+	}
+
+	out, err := ioutil.TempFile(*a.tmpDirectory, "pgCarpenter.")
+	if err != nil {
+		return 0, err
+	}
+	path := out.Name()
+	defer util.MustRemoveFile(path, a.logger)
+	err = a.storage.Get(a.ctx, entry.Key, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if entry.compressed() {
+		decompressed := path + ".decompressed"
+		if err := util.Decompress(path, decompressed); err != nil {
+			return 0, err
+		}
+		defer util.MustRemoveFile(decompressed, a.logger)
+		path = decompressed
+	}
+
+	return readSystemIdentifier(path)
+}
+
+// readSystemIdentifier returns the system identifier of the cluster, the first field of the pg_control file at path
+func readSystemIdentifier(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	// we open this for read only; there's no need to throw an error if closing it fails
+	defer f.Close()
+
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint64(buf), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestCheckDataDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgCarpenter.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name, stateFile := "backup", ""
+	var delta, force, modifiedOnly bool
+	a := &app{logger: zap.NewNop(), runState: &runState{}}
+	a.pgDataDirectory = &dir
+	a.backupName = &name
+	a.restoreStateFile = &stateFile
+	a.delta, a.force, a.modifiedOnly = &delta, &force, &modifiedOnly
+	m := newManifest(false)
+
+	if err := a.checkDataDirectory(m); err != nil {
+		t.Errorf("empty data directory: unexpected error: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "PG_VERSION"), []byte("15\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.checkDataDirectory(m); err == nil {
+		t.Error("data directory not empty: expected an error")
+	}
+	for _, flag := range []*bool{&delta, &force, &modifiedOnly} {
+		*flag = true
+		if err := a.checkDataDirectory(m); err != nil {
+			t.Errorf("unexpected error with delta %v, force %v, modified-only %v: %v", delta, force, modifiedOnly, err)
+		}
+		*flag = false
+	}
+
+	// a restore state file left by another backup is no reason to restore into the data directory
+	path := a.restoreStatePath()
+	if err := ioutil.WriteFile(path, []byte("other none\nPG_VERSION\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.checkDataDirectory(m); err == nil {
+		t.Error("stale restore state file: expected an error")
+	}
+
+	// unlike one left by an interrupted restore of this backup
+	fingerprint, err := manifestFingerprint(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(path)
+	s, err := openRestoreState(path, name, fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.file.Close()
+	if err := a.checkDataDirectory(m); err != nil {
+		t.Errorf("interrupted restore: unexpected error: %v", err)
+	}
+}
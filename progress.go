@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// how often progress is logged
+	progressLogInterval = 30 * time.Second
+	// how often the progress bar is redrawn, when writing to a terminal
+	progressBarInterval = time.Second
+	progressBarWidth    = 30
+)
+
+// progress keeps track of the files and bytes a backup or restore processed so far. A nil progress ignores updates.
+type progress struct {
+	// updated concurrently by the workers
+	files int64
+	bytes int64
+	// 0 if unknown; may be set once the operation is under way, see setTotals
+	totalFiles int64
+	totalBytes int64
+	operation  string
+	start      time.Time
+}
+
+// add records that files, totalling bytes, were processed
+func (p *progress) add(files int64, bytes int64) {
+	if p == nil {
+		return
+	}
+
+	atomic.AddInt64(&p.files, files)
+	atomic.AddInt64(&p.bytes, bytes)
+}
+
+// setTotals sets the number of files and bytes to process, for an operation that only learns them once under way
+func (p *progress) setTotals(files int64, bytes int64) {
+	if p == nil {
+		return
+	}
+
+	atomic.StoreInt64(&p.totalFiles, files)
+	atomic.StoreInt64(&p.totalBytes, bytes)
+}
+
+// return the bytes processed per second so far, and the estimated time left (0 if unknown)
+func (p *progress) rate() (float64, time.Duration) {
+	elapsed := time.Since(p.start)
+	bytes := atomic.LoadInt64(&p.bytes)
+	if bytes == 0 || elapsed <= 0 {
+		return 0, 0
+	}
+
+	throughput := float64(bytes) / elapsed.Seconds()
+	totalBytes := atomic.LoadInt64(&p.totalBytes)
+	if totalBytes <= bytes {
+		return throughput, 0
+	}
+
+	return throughput, time.Duration(float64(totalBytes-bytes) / throughput * float64(time.Second))
+}
+
+func (p *progress) log(logger *zap.Logger) {
+	throughput, eta := p.rate()
+	fields := []zap.Field{
+		zap.Int64("files", atomic.LoadInt64(&p.files)),
+		zap.Int64("bytes", atomic.LoadInt64(&p.bytes)),
+		zap.Float64("bytes_per_second", throughput),
+	}
+	if totalFiles := atomic.LoadInt64(&p.totalFiles); totalFiles > 0 {
+		fields = append(fields, zap.Int64("total_files", totalFiles))
+	}
+	if totalBytes := atomic.LoadInt64(&p.totalBytes); totalBytes > 0 {
+		fields = append(fields, zap.Int64("total_bytes", totalBytes), zap.Duration("eta", eta.Round(time.Second)))
+	}
+
+	logger.Info(p.operation+" progress", fields...)
+}
+
+// bar renders the progress as a single line, e.g.:
+//
+//	Restore [=========>                    ]  33% 1.2GB/3.6GB 45.0MB/s ETA 55s
+func (p *progress) bar() string {
+	bytes := atomic.LoadInt64(&p.bytes)
+	totalBytes := atomic.LoadInt64(&p.totalBytes)
+	throughput, eta := p.rate()
+	if totalBytes <= 0 {
+		return fmt.Sprintf("%s %d files %s %s/s", p.operation, atomic.LoadInt64(&p.files), formatBytes(bytes),
+			formatBytes(int64(throughput)))
+	}
+
+	ratio := float64(bytes) / float64(totalBytes)
+	if ratio > 1 {
+		ratio = 1
+	}
+	filled := int(ratio * progressBarWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+
+	return fmt.Sprintf("%s [%s] %3d%% %s/%s %s/s ETA %s", p.operation, bar, int(ratio*100), formatBytes(bytes),
+		formatBytes(totalBytes), formatBytes(int64(throughput)), eta.Round(time.Second))
+}
+
+// startProgress starts reporting the progress of operation, logging it every progressLogInterval and, if stderr is a
+// terminal, drawing a progress bar on it, until the returned function is called. Totals are 0 if unknown.
+func (a *app) startProgress(operation string, totalFiles int64, totalBytes int64) func() {
+	p := &progress{totalFiles: totalFiles, totalBytes: totalBytes, operation: operation, start: time.Now()}
+	a.progressMutex.Lock()
+	a.progress = p
+	a.progressMutex.Unlock()
+	tty := isTerminal(os.Stderr)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		logTicker := time.NewTicker(progressLogInterval)
+		defer logTicker.Stop()
+		barTicker := time.NewTicker(progressBarInterval)
+		defer barTicker.Stop()
+
+		for {
+			select {
+			case <-done:
+				if tty {
+					fmt.Fprintf(os.Stderr, "\r%s\n", p.bar())
+				}
+				p.log(a.logger)
+				return
+			case <-logTicker.C:
+				p.log(a.logger)
+			case <-barTicker.C:
+				if tty {
+					fmt.Fprintf(os.Stderr, "\r%s\033[K", p.bar())
+				}
+			}
+		}
+	}()
+
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+// currentProgress returns the progress of the operation in progress, if any; unlike a.progress, it's safe to call from
+// other goroutines than the command's (e.g., the daemon's API)
+func (a *app) currentProgress() *progress {
+	a.progressMutex.Lock()
+	defer a.progressMutex.Unlock()
+
+	return a.progress
+}
+
+// progressStatus is a snapshot of a progress, as shown by the daemon's API
+type progressStatus struct {
+	Operation      string  `json:"operation"`
+	Files          int64   `json:"files"`
+	Bytes          int64   `json:"bytes"`
+	TotalFiles     int64   `json:"total_files,omitempty"`
+	TotalBytes     int64   `json:"total_bytes,omitempty"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	ETASeconds     int64   `json:"eta_seconds,omitempty"`
+}
+
+// status returns a snapshot of p, or nil if p is nil
+func (p *progress) status() *progressStatus {
+	if p == nil {
+		return nil
+	}
+
+	throughput, eta := p.rate()
+
+	return &progressStatus{
+		Operation:      p.operation,
+		Files:          atomic.LoadInt64(&p.files),
+		Bytes:          atomic.LoadInt64(&p.bytes),
+		TotalFiles:     atomic.LoadInt64(&p.totalFiles),
+		TotalBytes:     atomic.LoadInt64(&p.totalBytes),
+		BytesPerSecond: throughput,
+		ETASeconds:     int64(eta.Seconds()),
+	}
+}
+
+// isTerminal returns true iff f is a terminal (or any other character device)
+func isTerminal(f *os.File) bool {
+	st, err := f.Stat()
+
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
+
+// formatBytes returns a human readable size, e.g., 1.5GB
+func formatBytes(bytes int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	size := float64(bytes)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", bytes, units[0])
+	}
+
+	return fmt.Sprintf("%.1f%s", size, units[i])
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
@@ -9,14 +10,12 @@ import (
 
 	"github.com/akamensky/argparse"
 	"github.com/pierrec/lz4"
+	"github.com/thumbtack/pgCarpenter/storage"
 	"github.com/thumbtack/pgCarpenter/util"
 	"go.uber.org/zap"
 )
 
-// we don't backup up empty directories, but the ones below must exist in order for PG to start
-var directoriesThatMustExist = []string{"pg_tblspc", "pg_replslot", "pg_stat", "pg_snapshots", "pg_xlog"}
-
-func (a *app) restoreBackup() int {
+func (a *app) restoreBackup() (exitCode int) {
 	// create a channel for distributing work
 	// spawn nWorkers
 	// list all files in backupName, and for each file:
@@ -43,8 +42,76 @@ func (a *app) restoreBackup() int {
 	a.logger.Info("Starting to restore backup", zap.String("name", *a.backupName))
 	begin := time.Now()
 
-	// channel to keep the path of all files that need to compressed and uploaded
-	restoreFilesC := make(chan string)
+	// backups created by older versions of pgCarpenter don't have a manifest
+	m, err := a.getManifest(*a.backupName)
+	if errors.Is(err, storage.ErrNotFound) {
+		a.logger.Debug("No manifest found, traversing the backup folder")
+	} else if err != nil {
+		// the files of deduplicated backups are not in the backup folder, traversing it would restore only some
+		a.logger.Error("Failed to read the manifest", zap.Error(err))
+		return 1
+	}
+
+	// restored files are owned by the given user, rather than the original owner
+	if *a.owner != "" {
+		a.restoreOwner, err = parseOwner(*a.owner)
+		if err != nil {
+			a.logger.Error("Invalid owner", zap.Error(err))
+			return 1
+		}
+	}
+
+	// the user may want to prepare for the restore (e.g., stop PG), or not restore at all
+	if err := a.runHook(a.ctx, "pre-restore", *a.preRestoreCommand, ""); err != nil {
+		a.logger.Error("Pre-restore hook failed, not restoring", zap.Error(err))
+		return 1
+	}
+	defer func() { a.runPostHook("post-restore", *a.postRestoreCommand, exitCode) }()
+
+	// don't overwrite a running cluster or someone else's data
+	if err := a.checkDataDirectory(m); err != nil {
+		a.logger.Error("Refusing to restore into the data directory", zap.Error(err))
+		return 1
+	}
+
+	// tablespaces live outside the data directory, linked from pg_tblspc, so the links must be in place before
+	// restoring any of their files
+	tablespaces, err := a.restoreTablespaces()
+	if err != nil {
+		a.logger.Error("Failed to restore tablespaces", zap.Error(err))
+		return 1
+	}
+
+	// keep track of the files restored so that an interrupted restore can be resumed
+	fingerprint, err := manifestFingerprint(m)
+	if err != nil {
+		a.logger.Error("Failed to identify the backup manifest", zap.Error(err))
+		return 1
+	}
+	a.restored, err = openRestoreState(a.restoreStatePath(), *a.backupName, fingerprint)
+	if err != nil {
+		a.logger.Error("Failed to open the restore state file", zap.Error(err))
+		return 1
+	}
+
+	// get rid of whatever is in the data directory but not in the backup
+	if *a.delta {
+		if err := a.removeExtraneousFiles(m); err != nil {
+			a.logger.Error("Failed to remove files not in the backup", zap.Error(err))
+			return 1
+		}
+	}
+
+	// channel to keep the manifest entries of all files that need to be downloaded and decompressed
+	restoreFilesC := make(chan manifestEntry)
+
+	// backups created by older versions have no manifest to tell how much there is to restore
+	var files, bytes int64
+	if m != nil {
+		files, bytes = int64(len(m.Files)), m.size()
+	}
+	stopProgress := a.startProgress("Restore", files, bytes)
+	defer stopProgress()
 
 	// spawn a pool of workers
 	a.logger.Info("Spawning workers", zap.Int("number", *a.nWorkers))
@@ -54,21 +121,43 @@ func (a *app) restoreBackup() int {
 		go a.restoreWorker(restoreFilesC, wg)
 	}
 
-	// kick off the (recursive) listing of all objects and put them in the restoreFilesC channel
-	// so that the workers can restore the files
-	if err := a.storage.WalkFolder(*a.backupName+"/", restoreFilesC); err != nil {
-		a.logger.Error("Failed to traverse backup folder", zap.Error(err))
-		return 1
-	}
+	// put every file listed in the backup's manifest in the restoreFilesC channel so that the workers can
+	// restore them
+	err = a.listBackupFiles(m, restoreFilesC)
 
 	// close the channel to signal there are no more items and wait for all workers to finish
 	a.logger.Info("Waiting for all workers to finish")
 	close(restoreFilesC)
 	wg.Wait()
 
+	if err != nil && !a.interrupted() {
+		a.fail("Failed to list backup files", *a.backupName, err)
+	}
+	// a restore with missing files is not usable; keep the state file so that it can be resumed
+	if a.failed() > 0 || a.interrupted() {
+		return a.reportFailures("Restore")
+	}
+
+	// the tablespace_map we just restored points to the original locations; PG would recreate the links to them
+	if len(*a.tablespaceMap) > 0 {
+		if err := a.writeTablespaceMap(tablespaces); err != nil {
+			a.logger.Error("Failed to write the remapped tablespace_map", zap.Error(err))
+			return 1
+		}
+	}
+
 	a.logger.Debug("Creating missing required directories")
 	a.createRequiredDirs()
 
+	if a.failed() > 0 {
+		return a.reportFailures("Restore")
+	}
+
+	// the restore is complete, nothing to resume anymore
+	if err := a.restored.remove(); err != nil {
+		a.logger.Error("Failed to remove the restore state file", zap.Error(err))
+	}
+
 	a.logger.Info(
 		"Backup successfully restored",
 		zap.Duration("seconds", time.Now().Sub(begin)),
@@ -77,16 +166,23 @@ func (a *app) restoreBackup() int {
 	return 0
 }
 
+// older backups don't include empty directories, but some must exist in order for PG to start; which ones depends
+// on the server version, which we get from the PG_VERSION file we just restored
 func (a *app) createRequiredDirs() {
-	for _, d := range directoriesThatMustExist {
+	serverVersion, err := readServerVersion(*a.pgDataDirectory)
+	if err != nil {
+		a.logger.Error("Failed to read the server version from PG_VERSION", zap.Error(err))
+	}
+
+	for _, d := range newExclusionRules(*a.pgDataDirectory, serverVersion, false, nil).requiredDirectories() {
 		path := filepath.Join(*a.pgDataDirectory, d)
 		// only try to create the directory if one does not already exist
 		_, err := os.Stat(path)
 		if os.IsNotExist(err) {
 			if err := os.Mkdir(path, 0700); err != nil {
 				// there's no benefit on interrupting the loop and returning an error
-				// might as well just log it and move on to the next directory
-				a.logger.Error("Failed to create directory", zap.Error(err))
+				// might as well just record it and move on to the next directory
+				a.fail("Failed to create directory", path, err)
 			}
 		}
 	}
@@ -94,7 +190,7 @@ func (a *app) createRequiredDirs() {
 
 // get the name of the last successful backup and update the configuration flag
 func (a *app) resolveLatest() (string, error) {
-	latest, err := a.storage.GetString(latestKey)
+	latest, err := a.storage.GetString(a.ctx, latestKey)
 	if err != nil {
 		return "", err
 	}
@@ -102,106 +198,228 @@ func (a *app) resolveLatest() (string, error) {
 	return latest, nil
 }
 
-func (a *app) restoreWorker(restoreFilesC <-chan string, wg *sync.WaitGroup) {
-	// continuously receive file paths (relative to the data directory)
-	// from the filesC channel, add them to tar files of up to ~1GB, and upload them
+// listBackupFiles puts an entry in filesC for each file of the backup, as listed in its manifest m. Backups created by
+// older versions of pgCarpenter don't have a manifest (m is nil), in which case the entries are derived from the keys
+// in the backup folder.
+func (a *app) listBackupFiles(m *manifest, filesC chan<- manifestEntry) error {
+	if m != nil {
+		a.logger.Debug("Restoring from manifest", zap.Int("files", len(m.Files)))
+		for _, f := range m.Files {
+			select {
+			case filesC <- f:
+			case <-a.ctx.Done():
+				return a.ctx.Err()
+			}
+		}
+		return nil
+	}
+
+	// translate keys into manifest entries as the traversal finds them
+	keysC := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for key := range keysC {
+			filesC <- entryFromKey(*a.backupName, key)
+		}
+	}()
+
+	err := a.storage.WalkFolder(a.ctx, *a.backupName+"/", keysC)
+	close(keysC)
+	<-done
+
+	return err
+}
+
+func (a *app) restoreWorker(restoreFilesC <-chan manifestEntry, wg *sync.WaitGroup) {
+	// continuously receive manifest entries from the restoreFilesC channel,
+	// download the corresponding objects, and decompress them
 	defer wg.Done()
 
 	for {
-		key, more := <-restoreFilesC
+		entry, more := <-restoreFilesC
 		if !more {
 			a.logger.Debug("No more files to process")
 			return
 		}
-
-		a.logger.Debug("Processing file", zap.String("remote", key))
-
-		// drop the backup name from the key to get the path relative to the data directory
-		file := strings.TrimPrefix(key, *a.backupName+"/")
-		dst := filepath.Join(*a.pgDataDirectory, file)
-		// if the object is a directory all we need to make sure is that it exists (any eventual
-		// content will be added at some point)
-		if util.IsObjectDirectory(dst) {
-			local := strings.TrimSuffix(dst, util.DirectoryExtension)
-			// create the directory iff it does not already exist
-			_, err := os.Stat(local)
-			if os.IsNotExist(err) {
-				if err := os.MkdirAll(local, os.ModePerm); err != nil {
-					a.logger.Error("Failed to create directory", zap.Error(err))
-				}
-			}
-			// regardless of whether or not the directory was successfully created, there's
-			// nothing else to do here
+		// once asked to stop, just drain the channel
+		if a.interrupted() {
 			continue
 		}
 
-		// get the modify time stored in the object's metadata
-		mtime, err := a.storage.GetLastModifiedTime(key)
-		// skip this file if the modify timestamp stored in the key's metadata matches the local version
-		if *a.modifiedOnly {
-			if err != nil {
-				a.logger.Error("Failed to get mtime", zap.Error(err), zap.String("key", key))
-			} else {
-				// the key may be of a compressed file in which case it'll include
-				// an extension that the local file does not have
-				local := strings.TrimSuffix(dst, lz4.Extension)
-				if a.fileHasNotChanged(local, mtime) {
-					a.logger.Debug("Skipping unmodified file", zap.String("remote", key))
-					continue
-				}
-			}
-		}
+		a.restoreEntry(entry)
+		a.progress.add(1, entry.Size)
+	}
+}
 
-		// if we've made it this far, the file needs to be restored
-		a.logger.Debug("Restoring file", zap.String("remote", key), zap.String("local", dst))
+// restoreEntry restores the file, directory or link described by entry, unless it's already in place
+func (a *app) restoreEntry(entry manifestEntry) {
+	key := entry.Key
+	a.logger.Debug("Processing file", zap.String("path", entry.Path), zap.String("remote", key))
 
-		// make sure the directory path exists
-		dir := filepath.Dir(dst)
-		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-			a.logger.Error("Failed to create the directory structure", zap.Error(err))
+	dst := filepath.Join(*a.pgDataDirectory, entry.Path)
+	// if the object is a directory all we need to make sure is that it exists (any eventual
+	// content will be added at some point)
+	if entry.Directory {
+		if entry.Link != "" {
+			if _, err := a.restoreLink(dst, entry); err != nil {
+				a.fail("Failed to restore symlink", entry.Path, err)
+			}
+			return
+		}
+		// create the directory iff it does not already exist
+		_, err := os.Stat(dst)
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(dst, defaultDirectoryMode); err != nil {
+				a.fail("Failed to create directory", entry.Path, err)
+				return
+			}
 		}
+		if err := a.applyAttributes(dst, entry); err != nil {
+			a.fail("Failed to set directory permissions", entry.Path, err)
+		}
+		return
+	}
 
-		// create the local file
-		out, err := os.Create(dst)
+	// links to files are restored as such if the target exists on this host
+	if entry.Link != "" {
+		linked, err := a.restoreLink(dst, entry)
 		if err != nil {
-			a.logger.Error("Failed to create file", zap.Error(err))
-			// no point on trying to continue
+			a.fail("Failed to restore symlink", entry.Path, err)
 			return
 		}
-		// download contents
-		err = a.storage.Get(key, out)
+		if linked {
+			return
+		}
+	}
+
+	// get the modify time from the manifest or, for older backups, the one stored in the object's metadata
+	mtime := entry.MTime
+	var err error
+	if mtime == 0 {
+		mtime, err = a.storage.GetLastModifiedTime(a.ctx, key)
+	}
+	// skip files a previous run already restored, as long as they were not changed since
+	if err == nil && a.restored.done(entry.Path) && a.fileHasNotChanged(dst, mtime) {
+		a.logger.Debug("Skipping file already restored", zap.String("remote", key))
+		return
+	}
+	// skip files whose contents already match the backup
+	if *a.delta && a.deltaUnchanged(dst, entry) {
+		a.logger.Debug("Skipping unchanged file", zap.String("remote", key))
+		if err := os.Chtimes(dst, time.Now(), time.Unix(mtime, 0)); err != nil {
+			a.fail("Failed to update mtime", entry.Path, err)
+		} else if err := a.applyAttributes(dst, entry); err != nil {
+			a.fail("Failed to set file permissions", entry.Path, err)
+		}
+		return
+	}
+	// skip this file if the modify timestamp matches the local version
+	if *a.modifiedOnly {
 		if err != nil {
-			a.logger.Error("Failed to download file", zap.Error(err))
-		}
-		// close the file
-		if err := out.Close(); err != nil {
-			a.logger.Error("Failed to close file", zap.Error(err))
-		}
-
-		// if the object we got is a compressed file, decompress it and remove the compressed one
-		localFile := out.Name()
-		if util.IsObjectCompressed(key) {
-			compressed := out.Name()
-			decompressed := strings.TrimSuffix(compressed, lz4.Extension)
-			localFile = decompressed
-			a.logger.Debug(
-				"Decompressing file",
-				zap.String("compressed", compressed),
-				zap.String("decompressed", decompressed))
-			if err := util.Decompress(compressed, decompressed); err != nil {
-				a.logger.Error("Failed to decompress file", zap.Error(err))
+			a.logger.Error("Failed to get mtime", zap.Error(err), zap.String("key", key))
+		} else {
+			if a.fileHasNotChanged(dst, mtime) {
+				a.logger.Debug("Skipping unmodified file", zap.String("remote", key))
+				return
 			}
-			util.MustRemoveFile(compressed, a.logger)
 		}
+	}
+
+	// if we've made it this far, the file needs to be restored; only files restored without errors are
+	// skipped when the restore is resumed
+	if a.restoreFile(entry, dst, mtime) {
+		if err := a.restored.markDone(entry.Path); err != nil {
+			a.logger.Error("Failed to update the restore state file", zap.Error(err))
+		}
+	}
+}
+
+// restoreFile downloads the object of entry to dst, decompressing it if needed, and sets its mtime, permissions and
+// ownership; errors are recorded in the failure log, in which case false is returned
+func (a *app) restoreFile(entry manifestEntry, dst string, mtime int64) bool {
+	key := entry.Key
+	a.logger.Debug("Restoring file", zap.String("remote", key), zap.String("local", dst))
 
-		// update the last modified time to match the one we just restored
-		if mtime != 0 {
-			a.logger.Debug("Updating mtime", zap.String("file", localFile), zap.Int64("time", mtime))
-			if err := os.Chtimes(localFile, time.Now(), time.Unix(mtime, 0)); err != nil {
-				a.logger.Error("Failed to update mtime", zap.Error(err))
+	// make sure the directory path exists
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, defaultDirectoryMode); err != nil {
+		a.fail("Failed to create the directory structure", dir, err)
+		return false
+	}
+
+	// never write through a symlink left in place of the file, or of the compressed file we download
+	paths := []string{dst}
+	if entry.compressed() {
+		paths = append(paths, dst+lz4.Extension)
+	}
+	for _, path := range paths {
+		if st, err := os.Lstat(path); err == nil && st.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(path); err != nil {
+				a.fail("Failed to remove symlink", path, err)
+				return false
 			}
 		}
 	}
+
+	// the object may be compressed in which case we download it to a file with the same extension
+	// and decompress it afterwards
+	if entry.compressed() {
+		dst += lz4.Extension
+	}
+
+	// create the local file
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defaultFileMode)
+	if err != nil {
+		a.fail("Failed to create file", dst, err)
+		return false
+	}
+	// download contents
+	err = a.storage.Get(a.ctx, key, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		a.fail("Failed to download file", key, err)
+		// don't leave a partial download behind
+		util.MustRemoveFile(dst, a.logger)
+		return false
+	}
+
+	// if the object we got is a compressed file, decompress it and remove the compressed one
+	localFile := out.Name()
+	if entry.compressed() {
+		compressed := out.Name()
+		decompressed := strings.TrimSuffix(compressed, lz4.Extension)
+		localFile = decompressed
+		a.logger.Debug(
+			"Decompressing file",
+			zap.String("compressed", compressed),
+			zap.String("decompressed", decompressed))
+		err := util.Decompress(compressed, decompressed)
+		util.MustRemoveFile(compressed, a.logger)
+		if err != nil {
+			a.fail("Failed to decompress file", compressed, err)
+			return false
+		}
+	}
+
+	// update the last modified time to match the one we just restored
+	if mtime != 0 {
+		a.logger.Debug("Updating mtime", zap.String("file", localFile), zap.Int64("time", mtime))
+		if err := os.Chtimes(localFile, time.Now(), time.Unix(mtime, 0)); err != nil {
+			a.fail("Failed to update mtime", localFile, err)
+			return false
+		}
+	}
+
+	// restore the original permissions and ownership
+	if err := a.applyAttributes(localFile, entry); err != nil {
+		a.fail("Failed to set file permissions", localFile, err)
+		return false
+	}
+
+	return true
 }
 
 func (a *app) fileHasNotChanged(localFile string, mtime int64) bool {
@@ -218,11 +436,57 @@ func (a *app) fileHasNotChanged(localFile string, mtime int64) bool {
 }
 
 func parseRestoreBackupArgs(cfg *app, parser *argparse.Command) {
-	cfg.modifiedOnly = parser.Flag(
-		"",
+	cfg.modifiedOnly = cfg.config.flag(
+		parser,
 		"modified-only",
+		"Restore into a data directory that is not empty, transferring only the files whose last modified "+
+			"timestamp changed")
+	cfg.delta = cfg.config.flag(
+		parser,
+		"delta",
+		"Remove files not in the backup from the data directory and restore only the files that differ "+
+			"from the backup, by checksum or by size and last modified timestamp")
+	cfg.force = cfg.config.flag(
+		parser,
+		"force",
+		"Restore into a data directory that is not empty, overwriting the files in the backup")
+	cfg.owner = parser.String(
+		"",
+		"owner",
+		&argparse.Options{
+			Required: false,
+			Default:  cfg.config.stringValue("owner", ""),
+			Help: "Restore files owned by the given user[:group] instead of the original owner (which requires " +
+				"running as root), e.g., when restoring onto a different host"})
+	cfg.tablespaceMap = parser.List(
+		"",
+		"tablespace-map",
+		&argparse.Options{
+			Required: false,
+			Default:  cfg.config.listValue("tablespace-map", nil),
+			Help:     "Restore the tablespace with the given OID to a new location (OID=/new/path, may be repeated)"})
+	cfg.restoreStateFile = parser.String(
+		"",
+		"state-file",
+		&argparse.Options{
+			Required: false,
+			Default:  cfg.config.stringValue("state-file", ""),
+			Help: "Keep track of the files restored in the given file, so that an interrupted restore picks up " +
+				"where it stopped (default: " + restoreStateFileName + " in the data directory)"})
+	cfg.preRestoreCommand = parser.String(
+		"",
+		"pre-restore-cmd",
+		&argparse.Options{
+			Required: false,
+			Default:  cfg.config.stringValue("pre-restore-cmd", ""),
+			Help: "Run the given shell command before restoring, which does not happen if the command fails " +
+				"(the backup name and data directory are passed as PGCARPENTER_BACKUP and PGCARPENTER_DATA_DIRECTORY)"})
+	cfg.postRestoreCommand = parser.String(
+		"",
+		"post-restore-cmd",
 		&argparse.Options{
 			Required: false,
-			Default:  false,
-			Help:     "Use the last modified timestamp to transfer only files that have changed)"})
+			Default:  cfg.config.stringValue("post-restore-cmd", ""),
+			Help: "Run the given shell command after restoring, whether it succeeded or not (PGCARPENTER_STATUS), " +
+				"with the same environment as --pre-restore-cmd"})
 }
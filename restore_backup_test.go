@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pierrec/lz4"
+	"go.uber.org/zap"
+)
+
+func TestRestoreFileReplacesSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgCarpenter.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside := filepath.Join(dir, "outside")
+	if err := ioutil.WriteFile(outside, []byte("untouched"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := []byte("restored contents")
+	compressed := &bytes.Buffer{}
+	w := lz4.NewWriter(compressed)
+	if _, err := w.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newMemoryStorage()
+	s.PutString(context.Background(), "backup/base/1/1", string(contents))
+	s.PutString(context.Background(), "backup/base/1/2.lz4", compressed.String())
+	a := &app{ctx: context.Background(), logger: zap.NewNop(), storage: s, runState: &runState{}}
+
+	for _, entry := range []manifestEntry{
+		{Path: "base/1/1", Key: "backup/base/1/1"},
+		{Path: "base/1/2", Key: "backup/base/1/2.lz4"},
+	} {
+		dst := filepath.Join(dir, "data", entry.Path)
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(outside, dst); err != nil {
+			t.Fatal(err)
+		}
+
+		if !a.restoreFile(entry, dst, 0) {
+			t.Fatalf("%s: failed to restore", entry.Path)
+		}
+		if st, err := os.Lstat(dst); err != nil || st.Mode()&os.ModeSymlink != 0 {
+			t.Errorf("%s: expected a regular file (%v)", entry.Path, err)
+		}
+		if restored, _ := ioutil.ReadFile(dst); !bytes.Equal(restored, contents) {
+			t.Errorf("%s: unexpected contents: %q", entry.Path, restored)
+		}
+		if target, _ := ioutil.ReadFile(outside); string(target) != "untouched" {
+			t.Errorf("%s: wrote through the symlink: %q", entry.Path, target)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// default name of the restore state file, created in the data directory
+const restoreStateFileName = "pgCarpenter.restore"
+
+// restoreState keeps track of the files a restore already completed in a local file, so that an interrupted restore
+// can pick up where it stopped. The first line identifies the backup being restored; each following line is the path
+// (relative to the data directory) of a file that was fully restored.
+type restoreState struct {
+	path      string
+	file      *os.File
+	completed map[string]bool
+	mutex     sync.Mutex
+}
+
+// restoreStatePath returns the path of the restore state file, by default in the data directory
+func (a *app) restoreStatePath() string {
+	if *a.restoreStateFile != "" {
+		return *a.restoreStateFile
+	}
+
+	return filepath.Join(*a.pgDataDirectory, restoreStateFileName)
+}
+
+// manifestFingerprint identifies the contents of a backup; older backups without a manifest only have a name
+func manifestFingerprint(m *manifest) (string, error) {
+	if m == nil {
+		return "none", nil
+	}
+
+	body, err := m.marshal()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(body))
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// openRestoreState opens the restore state file at path, creating it if it does not exist. An existing file must
+// have been created while restoring the same backup, with the same manifest, otherwise an error is returned.
+func openRestoreState(path string, backupName string, fingerprint string) (*restoreState, error) {
+	header := restoreStateHeader(backupName, fingerprint)
+	s := &restoreState{path: path, completed: make(map[string]bool)}
+
+	f, err := os.Open(path)
+	existed := err == nil
+	if existed {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		first := true
+		for scanner.Scan() {
+			line := scanner.Text()
+			if first {
+				if line != header {
+					f.Close()
+					return nil, errors.New(
+						"restore state file " + path + " belongs to a different backup (" + line + "), remove it to " +
+							"restore this one")
+				}
+				first = false
+				continue
+			}
+			s.completed[line] = true
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if first {
+			return nil, errors.New("restore state file " + path + " is empty, remove it to restart the restore")
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	s.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if !existed {
+		if _, err := s.file.WriteString(header + "\n"); err != nil {
+			s.file.Close()
+			return nil, err
+		}
+	}
+
+	return s, s.file.Sync()
+}
+
+// the first line of a restore state file, which identifies the backup being restored
+func restoreStateHeader(backupName string, fingerprint string) string {
+	return fmt.Sprintf("%s %s", backupName, fingerprint)
+}
+
+// isRestoreStateOf returns true iff the restore state file at path exists and was created while restoring the given
+// backup, with the same manifest, i.e., a restore of it was interrupted
+func isRestoreStateOf(path string, backupName string, fingerprint string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	// we open this for read only; there's no need to throw an error if closing it fails
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	return scanner.Scan() && scanner.Text() == restoreStateHeader(backupName, fingerprint)
+}
+
+// done returns true iff the file at path was completely restored by a previous run
+func (s *restoreState) done(path string) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.completed[path]
+}
+
+// markDone records that the file at path was completely restored
+func (s *restoreState) markDone(path string) error {
+	if s == nil {
+		return nil
+	}
+
+	// a path with a line break would corrupt the state file; the file would just be restored again
+	if strings.ContainsAny(path, "\r\n") {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.completed[path] = true
+	_, err := s.file.WriteString(path + "\n")
+
+	return err
+}
+
+// remove deletes the state file once the restore is complete
+func (s *restoreState) remove() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(s.path)
+}
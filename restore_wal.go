@@ -40,7 +40,7 @@ func (a *app) restoreWAL() int {
 	// don't exit without trying to remove the temporary file
 	defer util.MustRemoveFile(outTmp.Name(), a.logger)
 	// get the contents of the (compressed) WAL segment to the temporary file
-	err = a.storage.Get(key, outTmp)
+	err = a.storage.Get(a.ctx, key, outTmp)
 	if err != nil {
 		// this may not be an error. it's possible (especially on low traffic environments) that it
 		// takes a while to gather the 16MB a full WAL segment contains and a file is requested a few
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/thumbtack/pgCarpenter/storage"
+	"go.uber.org/zap"
+)
+
+// how often the manifest of a backup in progress is saved, so that an interrupted backup can be resumed
+const manifestCheckpointInterval = 60 * time.Second
+
+// files uploaded by an interrupted run of a backup, which a new run can reuse instead of uploading them again
+type resumeState struct {
+	// when the interrupted run started uploading files
+	startTime int64
+	files     map[string]manifestEntry
+	// blocks that failed page checksum verification, per file
+	checksumFailures map[string][]uint32
+}
+
+// loadResumeState checks that backupName is an unfinished backup that can be resumed, and returns the files its
+// previous run(s) managed to upload, according to the last saved manifest
+func (a *app) loadResumeState(backupName string) (*resumeState, error) {
+	if _, err := a.storage.GetString(a.ctx, a.getSuccessfulMarker(backupName)); err == nil {
+		return nil, errors.New("the backup already completed successfully")
+	}
+
+	state := &resumeState{
+		files:            make(map[string]manifestEntry),
+		checksumFailures: make(map[string][]uint32),
+	}
+
+	m, err := a.getManifest(backupName)
+	if errors.Is(err, storage.ErrNotFound) {
+		// the previous run did not get to save the manifest, so everything needs to be uploaded again
+		a.logger.Info("No manifest found, uploading all files again")
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.Deduplicated != *a.deduplicate {
+		return nil, errors.New("the backup was started with a different --deduplicate setting")
+	}
+
+	state.startTime = m.StartTime
+	for _, e := range m.Files {
+		if !e.Directory && e.Key != "" {
+			state.files[e.Path] = e
+		}
+	}
+	for _, f := range m.ChecksumFailures {
+		state.checksumFailures[f.Path] = f.Blocks
+	}
+	a.logger.Info("Resuming backup", zap.String("name", backupName), zap.Int("uploaded_files", len(state.files)))
+
+	return state, nil
+}
+
+// reuse returns the entry of pgFile as uploaded by the interrupted run, if the file did not change since then
+//
+// mtime has a resolution of one second, so a file modified right after being uploaded may still have the same mtime.
+// Only files last modified before the interrupted run started are reused, everything else is uploaded again.
+func (s *resumeState) reuse(pgFile string, size int64, mtime int64) (manifestEntry, bool) {
+	if s == nil {
+		return manifestEntry{}, false
+	}
+
+	e, ok := s.files[pgFile]
+	if !ok || e.Size != size || e.MTime != mtime || mtime >= s.startTime {
+		return manifestEntry{}, false
+	}
+
+	return e, true
+}
+
+// checkpointManifest saves the manifest of the backup in progress every manifestCheckpointInterval, until the
+// returned function is called; the latter waits for any save in progress, so it can be safely followed by saving the
+// final manifest
+func (a *app) checkpointManifest() func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(manifestCheckpointInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := a.putManifest(*a.backupName, a.manifest); err != nil {
+					// not fatal, it only means a resumed backup would upload more files again
+					a.logger.Warn("Failed to save the backup manifest", zap.Error(err))
+				}
+			}
+		}
+	}()
+
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// handleSignals cancels the context of the command on SIGINT or SIGTERM, so that it can stop gracefully: workers stop
+// picking up new files, transfers in progress are aborted, and the command cleans up after itself. A second signal
+// terminates the process immediately.
+func (a *app) handleSignals(cancel context.CancelFunc) {
+	signalsC := make(chan os.Signal, 1)
+	signal.Notify(signalsC, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signalsC
+	a.logger.Warn("Received signal, stopping", zap.String("signal", sig.String()))
+	// restore the default behavior
+	signal.Stop(signalsC)
+	cancel()
+}
+
+// interrupted returns true iff the command was asked to stop
+func (a *app) interrupted() bool {
+	return a.ctx.Err() != nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// how often to check whether a standby has replayed, or the primary archived, the WAL a backup needs
+const standbyPollInterval = 10 * time.Second
+
+// the start WAL segment as written in backup_label, e.g., START WAL LOCATION: 0/2000028 (file 000000010000000000000002)
+var startWALFileRE = regexp.MustCompile(`START WAL LOCATION: [0-9A-F]+/[0-9A-F]+ \(file ([0-9A-F]{24})\)`)
+
+// checkRecoveryState makes sure we're connected to a standby iff --standby was given; backups from a standby also
+// need the WAL segment size to figure out which segments to wait for
+func (a *app) checkRecoveryState(ctx context.Context, conn *sql.Conn) error {
+	var inRecovery bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery); err != nil {
+		return err
+	}
+
+	if inRecovery && !*a.standby {
+		return errors.New("connected to a standby, use --standby to take a backup from it")
+	}
+	if !inRecovery && *a.standby {
+		return errors.New("--standby given but the server is not in recovery")
+	}
+	if !*a.standby {
+		return nil
+	}
+
+	// the unit changed from 8kB to bytes in PG 11
+	var setting, unit string
+	err := conn.QueryRowContext(
+		ctx,
+		"SELECT setting, unit FROM pg_settings WHERE name = 'wal_segment_size'",
+	).Scan(&setting, &unit)
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseUint(setting, 10, 64)
+	if err != nil {
+		return err
+	}
+	switch unit {
+	case "8kB":
+		size *= 8192
+	case "MB":
+		size *= 1024 * 1024
+	}
+	a.walSegmentSize = size
+	a.logger.Info("Taking backup from a standby", zap.Uint64("wal_segment_size", a.walSegmentSize))
+
+	return nil
+}
+
+// waitForReplay blocks until the standby has replayed all WAL up to the backup's stop LSN
+func (a *app) waitForReplay(ctx context.Context, conn *sql.Conn) error {
+	query := "SELECT pg_last_wal_replay_lsn() >= $1::pg_lsn"
+	if a.serverVersion < 100000 {
+		query = "SELECT pg_last_xlog_replay_location() >= $1::pg_lsn"
+	}
+
+	deadline := time.Now().Add(time.Duration(*a.archiveTimeout) * time.Second)
+	for {
+		var replayed bool
+		if err := conn.QueryRowContext(ctx, query, a.stopLSN).Scan(&replayed); err != nil {
+			return err
+		}
+		if replayed {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for the stop LSN to be replayed: " + a.stopLSN)
+		}
+		a.logger.Info("Waiting for the stop LSN to be replayed", zap.String("lsn", a.stopLSN))
+		select {
+		case <-time.After(standbyPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// waitForArchivedWAL blocks until all WAL segments between the start and the stop of the backup have been archived;
+// a standby does not archive WAL (unless archive_mode = always), so we must wait for the primary to do it
+func (a *app) waitForArchivedWAL(labelFile string) error {
+	m := startWALFileRE.FindStringSubmatch(labelFile)
+	if m == nil {
+		return errors.New("start WAL location not found in backup_label")
+	}
+	timeline, err := strconv.ParseUint(m[1][:8], 16, 32)
+	if err != nil {
+		return err
+	}
+	first, err := walSegmentNumber(m[1], a.walSegmentSize)
+	if err != nil {
+		return err
+	}
+	stop, err := parseLSN(a.stopLSN)
+	if err != nil {
+		return err
+	}
+	// the stop LSN may be at the very beginning of a segment, which is then not required
+	last := (stop - 1) / a.walSegmentSize
+
+	deadline := time.Now().Add(time.Duration(*a.archiveTimeout) * time.Second)
+	for segment := first; segment <= last; segment++ {
+		name := walSegmentName(timeline, segment, a.walSegmentSize)
+		key := a.getWALObjectKey(name)
+		for {
+			if _, err := a.storage.GetLastModifiedTime(a.ctx, key); err == nil {
+				a.logger.Debug("WAL segment archived", zap.String("key", key))
+				break
+			}
+
+			if time.Now().After(deadline) {
+				return errors.New("timed out waiting for WAL segment to be archived: " + name)
+			}
+			a.logger.Info("Waiting for WAL segment to be archived by the primary", zap.String("segment", name))
+			select {
+			case <-time.After(standbyPollInterval):
+			case <-a.ctx.Done():
+				return a.ctx.Err()
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseLSN converts the text representation of an LSN (e.g., 16/B374D848) into a number
+func parseLSN(lsn string) (uint64, error) {
+	parts := strings.SplitN(lsn, "/", 2)
+	if len(parts) != 2 {
+		return 0, errors.New("invalid LSN: " + lsn)
+	}
+	high, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	low, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return high<<32 | low, nil
+}
+
+// walSegmentName returns the file name of the WAL segment with the given number on timeline
+func walSegmentName(timeline uint64, segment uint64, segmentSize uint64) string {
+	segmentsPerID := 0x100000000 / segmentSize
+
+	return fmt.Sprintf("%08X%08X%08X", timeline, segment/segmentsPerID, segment%segmentsPerID)
+}
+
+// walSegmentNumber is the inverse of walSegmentName (ignoring the timeline)
+func walSegmentNumber(name string, segmentSize uint64) (uint64, error) {
+	if len(name) != 24 {
+		return 0, errors.New("invalid WAL segment name: " + name)
+	}
+	id, err := strconv.ParseUint(name[8:16], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	seg, err := strconv.ParseUint(name[16:], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return id*(0x100000000/segmentSize) + seg, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestParseLSN(t *testing.T) {
+	tests := []struct {
+		lsn      string
+		expected uint64
+	}{
+		{"0/0", 0},
+		{"0/16B3748", 0x16B3748},
+		{"16/B374D848", 0x16B374D848},
+		{"FFFFFFFF/FFFFFFFF", 0xFFFFFFFFFFFFFFFF},
+	}
+	for _, test := range tests {
+		lsn, err := parseLSN(test.lsn)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.lsn, err)
+			continue
+		}
+		if lsn != test.expected {
+			t.Errorf("%s: expected %X, got %X", test.lsn, test.expected, lsn)
+		}
+		if s := formatLSN(lsn); s != test.lsn {
+			t.Errorf("%s: formatted as %s", test.lsn, s)
+		}
+	}
+
+	for _, lsn := range []string{"", "16", "16/", "/B374D848", "G/0", "100000000/0", "0/100000000"} {
+		if _, err := parseLSN(lsn); err == nil {
+			t.Errorf("%q: expected an error", lsn)
+		}
+	}
+}
+
+func TestWALSegmentName(t *testing.T) {
+	tests := []struct {
+		timeline    uint64
+		segment     uint64
+		segmentSize uint64
+		expected    string
+	}{
+		{1, 0, 16 * 1024 * 1024, "000000010000000000000000"},
+		{1, 255, 16 * 1024 * 1024, "0000000100000000000000FF"},
+		{1, 256, 16 * 1024 * 1024, "000000010000000100000000"},
+		{2, 0x16B3, 16 * 1024 * 1024, "0000000200000016000000B3"},
+		{1, 4097, 1024 * 1024, "000000010000000100000001"},
+		{0xA, 129, 64 * 1024 * 1024, "0000000A0000000200000001"},
+	}
+	for _, test := range tests {
+		name := walSegmentName(test.timeline, test.segment, test.segmentSize)
+		if name != test.expected {
+			t.Errorf("segment %d of %d bytes: expected %s, got %s", test.segment, test.segmentSize, test.expected, name)
+		}
+		segment, err := walSegmentNumber(name, test.segmentSize)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		if segment != test.segment {
+			t.Errorf("%s: expected segment %d, got %d", name, test.segment, segment)
+		}
+	}
+
+	invalid := []string{"", "00000001000000000000000", "00000001000000000000000G", "000000010000000000000000.partial"}
+	for _, name := range invalid {
+		if _, err := walSegmentNumber(name, 16*1024*1024); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package s3storage
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"os"
 	"strconv"
@@ -9,11 +10,13 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/thumbtack/pgCarpenter/storage"
+	"github.com/thumbtack/pgCarpenter/throttle"
 	"go.uber.org/zap"
 )
 
@@ -30,10 +33,24 @@ type s3Storage struct {
 	downloader *s3manager.Downloader
 	bucket     string
 	logger     *zap.Logger
+	// shared by all uploads and downloads (of files; small objects are not throttled), either may be nil
+	uploadLimiter   *throttle.Limiter
+	downloadLimiter *throttle.Limiter
 }
 
-func New(bucket string, region string, maxRetries int, logger *zap.Logger) storage.Storage {
-	backend := &s3Storage{bucket: bucket, logger: logger}
+func New(
+	bucket string,
+	region string,
+	maxRetries int,
+	uploadLimiter *throttle.Limiter,
+	downloadLimiter *throttle.Limiter,
+	logger *zap.Logger) storage.Storage {
+	backend := &s3Storage{
+		bucket:          bucket,
+		logger:          logger,
+		uploadLimiter:   uploadLimiter,
+		downloadLimiter: downloadLimiter,
+	}
 
 	// generic S3 client
 	backend.client = s3.New(session.Must(
@@ -63,7 +80,7 @@ func New(bucket string, region string, maxRetries int, logger *zap.Logger) stora
 	return backend
 }
 
-func (s s3Storage) Put(objectKey string, localPath string, mtime int64) error {
+func (s s3Storage) Put(ctx context.Context, objectKey string, localPath string, mtime int64) error {
 	// open the compressed file to upload
 	file, err := os.Open(localPath)
 	if err != nil {
@@ -87,9 +104,16 @@ func (s s3Storage) Put(objectKey string, localPath string, mtime int64) error {
 
 	s.logger.Debug("Uploading file", zap.String("objectKey", objectKey), zap.String("localPath", localPath))
 	if size > 5*1024*1024 {
-		_, err = s.uploader.Upload(getUploadInput(&s.bucket, &objectKey, body, mtime))
+		// the uploader reads the parts it sends concurrently at their offsets, unless the body can't do that, in
+		// which case it buffers each of them
+		throttled := throttle.NewReadSeekerAt(ctx, body, s.uploadLimiter)
+		_, err = s.uploader.UploadWithContext(ctx, getUploadInput(&s.bucket, &objectKey, throttled, mtime))
 	} else {
-		_, err = s.client.PutObject(getPutObjectInput(&s.bucket, &objectKey, body, mtime))
+		// small files go in a single request, which may need to be retried (i.e., the body must be seekable)
+		if err := s.uploadLimiter.Wait(ctx, int(size)); err != nil {
+			return err
+		}
+		_, err = s.client.PutObjectWithContext(ctx, getPutObjectInput(&s.bucket, &objectKey, body, mtime))
 	}
 	if err != nil {
 		return err
@@ -98,10 +122,22 @@ func (s s3Storage) Put(objectKey string, localPath string, mtime int64) error {
 	return nil
 }
 
-func (s s3Storage) PutString(key string, body string) error {
+func (s s3Storage) PutReader(ctx context.Context, objectKey string, body io.Reader, mtime int64) error {
+	s.logger.Debug("Uploading stream", zap.String("objectKey", objectKey))
+	// the uploader buffers each part of a body it can't seek, so that it can retry sending it
+	_, err := s.uploader.UploadWithContext(
+		ctx,
+		getUploadInput(&s.bucket, &objectKey, throttle.NewReader(ctx, body, s.uploadLimiter), mtime))
+
+	return err
+}
+
+func (s s3Storage) PutString(ctx context.Context, key string, body string) error {
 	s.logger.Debug("Creating object", zap.String("key", key))
 
-	_, err := s.client.PutObject(getPutObjectInput(&s.bucket, &key, strings.NewReader(body), time.Now().Unix()))
+	_, err := s.client.PutObjectWithContext(
+		ctx,
+		getPutObjectInput(&s.bucket, &key, strings.NewReader(body), time.Now().Unix()))
 	if err != nil {
 		return err
 	}
@@ -109,9 +145,10 @@ func (s s3Storage) PutString(key string, body string) error {
 	return nil
 }
 
-func (s s3Storage) Get(key string, out io.WriterAt) error {
-	_, err := s.downloader.Download(
-		out,
+func (s s3Storage) Get(ctx context.Context, key string, out io.WriterAt) error {
+	_, err := s.downloader.DownloadWithContext(
+		ctx,
+		throttle.NewWriterAt(ctx, out, s.downloadLimiter),
 		&s3.GetObjectInput{
 			Bucket: aws.String(s.bucket),
 			Key:    aws.String(key),
@@ -123,11 +160,14 @@ func (s s3Storage) Get(key string, out io.WriterAt) error {
 	return nil
 }
 
-func (s s3Storage) GetString(key string) (string, error) {
-	result, err := s.client.GetObject(&s3.GetObjectInput{
+func (s s3Storage) GetString(ctx context.Context, key string) (string, error) {
+	result, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return "", storage.ErrNotFound
+	}
 	if err != nil {
 		return "", err
 	}
@@ -143,8 +183,8 @@ func (s s3Storage) GetString(key string) (string, error) {
 	return buf.String(), nil
 }
 
-func (s s3Storage) GetLastModifiedTime(key string) (int64, error) {
-	result, err := s.client.HeadObject(&s3.HeadObjectInput{
+func (s s3Storage) GetLastModifiedTime(ctx context.Context, key string) (int64, error) {
+	result, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 	})
@@ -165,7 +205,7 @@ func (s s3Storage) GetLastModifiedTime(key string) (int64, error) {
 	return 0, nil
 }
 
-func (s s3Storage) ListFolder(path string) ([]string, error) {
+func (s s3Storage) ListFolder(ctx context.Context, path string) ([]string, error) {
 	keys := make([]string, 0)
 
 	var next *string = nil
@@ -180,7 +220,7 @@ func (s s3Storage) ListFolder(path string) ([]string, error) {
 		if next != nil {
 			input.ContinuationToken = next
 		}
-		result, err := s.client.ListObjectsV2(input)
+		result, err := s.client.ListObjectsV2WithContext(ctx, input)
 		if err != nil {
 			return nil, err
 		}
@@ -199,7 +239,7 @@ func (s s3Storage) ListFolder(path string) ([]string, error) {
 	}
 }
 
-func (s s3Storage) WalkFolder(path string, keysC chan<- string) error {
+func (s s3Storage) WalkFolder(ctx context.Context, path string, keysC chan<- string) error {
 	var next *string = nil
 	for {
 		input := &s3.ListObjectsV2Input{
@@ -211,7 +251,7 @@ func (s s3Storage) WalkFolder(path string, keysC chan<- string) error {
 		if next != nil {
 			input.ContinuationToken = next
 		}
-		result, err := s.client.ListObjectsV2(input)
+		result, err := s.client.ListObjectsV2WithContext(ctx, input)
 		if err != nil {
 			return err
 		}
@@ -223,13 +263,17 @@ func (s s3Storage) WalkFolder(path string, keysC chan<- string) error {
 				s.logger.Debug("Skipping parent folder", zap.String("path", *obj.Key))
 				continue
 			}
-			keysC <- *obj.Key
+			select {
+			case keysC <- *obj.Key:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
 
 		// child folders to process
 		for _, p := range result.CommonPrefixes {
 			s.logger.Debug("Processing child folder", zap.String("prefix", *p.Prefix))
-			if err := s.WalkFolder(*p.Prefix, keysC); err != nil {
+			if err := s.WalkFolder(ctx, *p.Prefix, keysC); err != nil {
 				return err
 			}
 		}
@@ -243,13 +287,13 @@ func (s s3Storage) WalkFolder(path string, keysC chan<- string) error {
 	}
 }
 
-func (s s3Storage) Delete(key string) error {
+func (s s3Storage) Delete(ctx context.Context, key string) error {
 	input := &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 	}
 
-	_, err := s.client.DeleteObject(input)
+	_, err := s.client.DeleteObjectWithContext(ctx, input)
 
 	return err
 }
@@ -1,26 +1,35 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"io"
 )
 
+// ErrNotFound is returned by GetString when the object does not exist, as opposed to failing to read it.
+var ErrNotFound = errors.New("object not found")
+
+// Storage is a remote object store. All methods stop and return an error as soon as ctx is canceled.
 type Storage interface {
 	// Put stores the contents of the local file path in the object identified by key. It also
 	// stores the last modified timestamp (mtime) in the object's metadata.
-	Put(key string, localPath string, mtime int64) error
+	Put(ctx context.Context, key string, localPath string, mtime int64) error
+	// PutReader stores everything read from body, until EOF, in the object identified by key. Like Put, it also
+	// stores mtime in the object's metadata.
+	PutReader(ctx context.Context, key string, body io.Reader, mtime int64) error
 	// PutString stores the value of body as the content of the object identified by key.
-	PutString(key string, body string) error
+	PutString(ctx context.Context, key string, body string) error
 	// Get writes the contents of the object identified by key into out.
-	Get(key string, out io.WriterAt) error
-	// GetString returns the contents of the object as a string.
-	GetString(key string) (string, error)
+	Get(ctx context.Context, key string, out io.WriterAt) error
+	// GetString returns the contents of the object as a string, or ErrNotFound if there's no such object.
+	GetString(ctx context.Context, key string) (string, error)
 	// GetLastModifiedTime returns the modified time as stored in the objects metadata.
-	GetLastModifiedTime(key string) (int64, error)
+	GetLastModifiedTime(ctx context.Context, key string) (int64, error)
 	// ListFolder returns the contents (list of strings) of the folder rooted at path.
-	ListFolder(path string) ([]string, error)
+	ListFolder(ctx context.Context, path string) ([]string, error)
 	// WalkFolder traverses the folder rooted at path, putting each object it finds in the channel keysC.
 	// If an error occurs the traversal is interrupted and the error returned.
-	WalkFolder(path string, keysC chan<- string) error
+	WalkFolder(ctx context.Context, path string, keysC chan<- string) error
 	// Delete removes the folder path and all its contents.
-	Delete(key string) error
+	Delete(ctx context.Context, key string) error
 }
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/thumbtack/pgCarpenter/util"
+	"go.uber.org/zap"
+)
+
+// the default WAL segment size; the only one available before PG 11
+const defaultWALSegmentSize = 16 * 1024 * 1024
+
+// the replication protocol measures time in microseconds since 2000-01-01 00:00:00 UTC
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// the names PG accepts for replication slots (up to NAMEDATALEN - 1 characters); the name goes unquoted into
+// replication commands
+var slotNameRE = regexp.MustCompile(`^[a-z0-9_]{1,63}$`)
+
+func (a *app) streamWAL() int {
+	// flags are validated by the parser, settings from the environment or the configuration file are not
+	if err := validateSlotName([]string{*a.slotName}); err != nil {
+		a.logger.Error("Invalid replication slot", zap.Error(err))
+		return 1
+	}
+	a.logger.Info("Starting to stream WAL", zap.String("slot", *a.slotName))
+
+	connStr, err := a.connInfo()
+	if err != nil {
+		a.logger.Error("Failed to build the connection string", zap.Error(err))
+		return 1
+	}
+
+	ctx := a.ctx
+	conn, err := pgconn.Connect(ctx, connStr+" replication='true'")
+	if err != nil {
+		a.logger.Error("Failed to connect to PostgreSQL", zap.Error(err))
+		return 1
+	}
+	defer conn.Close(context.Background())
+
+	identity, err := conn.Exec(ctx, "IDENTIFY_SYSTEM").ReadAll()
+	if err != nil {
+		a.logger.Error("Failed to identify system", zap.Error(err))
+		return 1
+	}
+	if len(identity) == 0 || len(identity[0].Rows) == 0 || len(identity[0].Rows[0]) < 3 {
+		a.logger.Error("Failed to identify system", zap.Error(errors.New("unexpected response to IDENTIFY_SYSTEM")))
+		return 1
+	}
+	row := identity[0].Rows[0]
+	timeline, err := strconv.ParseUint(string(row[1]), 10, 32)
+	if err != nil {
+		a.logger.Error("Failed to parse timeline", zap.Error(err))
+		return 1
+	}
+	a.walSegmentSize = a.showWALSegmentSize(conn)
+
+	// resume from where the slot was left off, or from the current position if it's a new one
+	start, err := a.slotRestartLSN(conn, connStr)
+	if err != nil {
+		a.logger.Error("Failed to get the replication slot's restart LSN", zap.Error(err))
+		return 1
+	}
+	if start == 0 {
+		if start, err = parseLSN(string(row[2])); err != nil {
+			a.logger.Error("Failed to parse the current WAL position", zap.Error(err))
+			return 1
+		}
+	}
+	// we only ever archive whole segments, start from the beginning of this one
+	start -= start % a.walSegmentSize
+
+	for {
+		a.logger.Info(
+			"Starting replication",
+			zap.String("lsn", formatLSN(start)),
+			zap.Uint64("timeline", timeline))
+		next, nextStart, err := a.streamTimeline(conn, timeline, start)
+		if err != nil && a.interrupted() {
+			// the slot keeps the WAL we did not archive yet; it will be streamed again next time
+			a.logger.Info("Stopped streaming WAL")
+			return 0
+		}
+		if err != nil {
+			a.logger.Error("Failed to stream WAL", zap.Error(err))
+			return 1
+		}
+
+		// the server switched to a new timeline, keep its history along with the WAL
+		a.logger.Info("Switching timeline", zap.Uint64("timeline", next), zap.String("lsn", formatLSN(nextStart)))
+		if err := a.archiveTimelineHistory(conn, next); err != nil {
+			a.logger.Error("Failed to archive timeline history", zap.Error(err))
+			return 1
+		}
+		timeline = next
+		start = nextStart - nextStart%a.walSegmentSize
+	}
+}
+
+// return the restart LSN of the physical replication slot, creating it if it doesn't exist and we were asked to; 0
+// means the slot does not have one yet
+func (a *app) slotRestartLSN(conn *pgconn.PgConn, connStr string) (uint64, error) {
+	// slots can only be inspected over a regular connection
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	query := "SELECT restart_lsn FROM pg_replication_slots WHERE slot_name = $1 AND slot_type = 'physical'"
+	var restartLSN sql.NullString
+	err = db.QueryRowContext(a.ctx, query, *a.slotName).Scan(&restartLSN)
+	if err == sql.ErrNoRows {
+		if !*a.createSlot {
+			return 0, errors.New("replication slot not found (use --create-slot): " + *a.slotName)
+		}
+		a.logger.Info("Creating replication slot", zap.String("slot", *a.slotName))
+		cmd := fmt.Sprintf("CREATE_REPLICATION_SLOT %s PHYSICAL RESERVE_WAL", *a.slotName)
+		if _, err := conn.Exec(a.ctx, cmd).ReadAll(); err != nil {
+			return 0, err
+		}
+		err = db.QueryRowContext(a.ctx, query, *a.slotName).Scan(&restartLSN)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if !restartLSN.Valid {
+		return 0, nil
+	}
+
+	return parseLSN(restartLSN.String)
+}
+
+// SHOW is only supported over replication connections from PG 10 on, before which the segment size is fixed anyway
+func (a *app) showWALSegmentSize(conn *pgconn.PgConn) uint64 {
+	results, err := conn.Exec(a.ctx, "SHOW wal_segment_size").ReadAll()
+	if err != nil || len(results) == 0 || len(results[0].Rows) == 0 || len(results[0].Rows[0]) == 0 {
+		a.logger.Debug("Failed to get the WAL segment size, using the default", zap.Error(err))
+		return defaultWALSegmentSize
+	}
+
+	size, err := parseSize(string(results[0].Rows[0][0]))
+	if err != nil {
+		a.logger.Debug("Failed to parse the WAL segment size, using the default", zap.Error(err))
+		return defaultWALSegmentSize
+	}
+
+	return size
+}
+
+// streamTimeline streams WAL on timeline, starting at the beginning of a segment, until the server switches to a
+// new one; it returns the new timeline and the position it starts at
+func (a *app) streamTimeline(conn *pgconn.PgConn, timeline uint64, start uint64) (uint64, uint64, error) {
+	ctx := a.ctx
+	cmd := fmt.Sprintf("START_REPLICATION SLOT %s PHYSICAL %s TIMELINE %d", *a.slotName, formatLSN(start), timeline)
+	conn.Frontend().Send(&pgproto3.Query{String: cmd})
+	if err := conn.Frontend().Flush(); err != nil {
+		return 0, 0, err
+	}
+
+	// wait for the server to start streaming
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+		if _, ok := msg.(*pgproto3.CopyBothResponse); ok {
+			break
+		}
+		if e, ok := msg.(*pgproto3.ErrorResponse); ok {
+			return 0, 0, pgconn.ErrorResponseToPgError(e)
+		}
+	}
+
+	w := &walWriter{app: a, timeline: timeline, received: start, flushed: start}
+	defer w.discard()
+
+	statusInterval := time.Duration(*a.statusInterval) * time.Second
+	partialInterval := time.Duration(*a.partialInterval) * time.Second
+	nextStatus := time.Now().Add(statusInterval)
+	nextPartial := time.Now().Add(partialInterval)
+	for {
+		deadline := nextStatus
+		if nextPartial.Before(deadline) {
+			deadline = nextPartial
+		}
+		recvCtx, cancel := context.WithDeadline(ctx, deadline)
+		msg, err := conn.ReceiveMessage(recvCtx)
+		cancel()
+		if err != nil && !pgconn.Timeout(err) {
+			return 0, 0, err
+		}
+
+		replyRequested := false
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			if len(msg.Data) == 0 {
+				continue
+			}
+			switch msg.Data[0] {
+			case 'w':
+				// XLogData: start of the data, current end of WAL on the server, send time, and the data itself
+				if len(msg.Data) < 25 {
+					return 0, 0, errors.New("invalid XLogData message")
+				}
+				dataStart := binary.BigEndian.Uint64(msg.Data[1:])
+				segmentsDone, err := w.write(dataStart, msg.Data[25:])
+				if err != nil {
+					return 0, 0, err
+				}
+				// let the server know as soon as it can recycle the WAL we archived
+				replyRequested = segmentsDone
+			case 'k':
+				// primary keepalive: current end of WAL on the server, send time, and whether a reply is expected
+				if len(msg.Data) < 18 {
+					return 0, 0, errors.New("invalid keepalive message")
+				}
+				replyRequested = msg.Data[17] == 1
+			}
+		case *pgproto3.CopyDone:
+			// the end of the timeline; whatever we have of the last segment is all there is going to be
+			if err := w.uploadPartial(); err != nil {
+				return 0, 0, err
+			}
+			return a.endOfTimeline(conn)
+		case *pgproto3.ErrorResponse:
+			return 0, 0, pgconn.ErrorResponseToPgError(msg)
+		}
+
+		if time.Now().After(nextPartial) {
+			if err := w.uploadPartial(); err != nil {
+				return 0, 0, err
+			}
+			nextPartial = time.Now().Add(partialInterval)
+		}
+		if replyRequested || time.Now().After(nextStatus) {
+			if err := sendStandbyStatus(conn, w.received, w.flushed); err != nil {
+				return 0, 0, err
+			}
+			nextStatus = time.Now().Add(statusInterval)
+		}
+	}
+}
+
+// acknowledge the end of the COPY stream and read the next timeline and its start position
+func (a *app) endOfTimeline(conn *pgconn.PgConn) (uint64, uint64, error) {
+	conn.Frontend().Send(&pgproto3.CopyDone{})
+	if err := conn.Frontend().Flush(); err != nil {
+		return 0, 0, err
+	}
+
+	var timeline, start uint64
+	for {
+		msg, err := conn.ReceiveMessage(a.ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.DataRow:
+			if len(msg.Values) < 2 {
+				return 0, 0, errors.New("unexpected response at the end of the timeline")
+			}
+			if timeline, err = strconv.ParseUint(string(msg.Values[0]), 10, 32); err != nil {
+				return 0, 0, err
+			}
+			if start, err = parseLSN(string(msg.Values[1])); err != nil {
+				return 0, 0, err
+			}
+		case *pgproto3.ErrorResponse:
+			return 0, 0, pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.ReadyForQuery:
+			if timeline == 0 {
+				return 0, 0, errors.New("replication ended without switching to a new timeline")
+			}
+			return timeline, start, nil
+		}
+	}
+}
+
+// archive the history file of timeline the same way archive-wal would
+func (a *app) archiveTimelineHistory(conn *pgconn.PgConn, timeline uint64) error {
+	results, err := conn.Exec(a.ctx, fmt.Sprintf("TIMELINE_HISTORY %d", timeline)).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 || len(results[0].Rows) == 0 || len(results[0].Rows[0]) < 2 {
+		return errors.New("unexpected response to TIMELINE_HISTORY")
+	}
+	row := results[0].Rows[0]
+
+	f, err := ioutil.TempFile(*a.tmpDirectory, "pgCarpenter.")
+	if err != nil {
+		return err
+	}
+	defer util.MustRemoveFile(f.Name(), a.logger)
+	if _, err := f.Write(row[1]); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return a.putWAL(string(row[0]), f.Name())
+}
+
+// putWAL compresses and uploads the file at path as the WAL file name
+func (a *app) putWAL(name string, path string) error {
+	compressed, err := util.Compress(path, *a.tmpDirectory)
+	if err != nil {
+		return err
+	}
+	// regardless of whether or not the upload operation was successful, remove the compressed file
+	defer util.MustRemoveFile(compressed, a.logger)
+
+	return a.storage.Put(a.ctx, a.getWALObjectKey(name), compressed, 0)
+}
+
+// send a standby status update; flushed is what we already archived, i.e., what the slot no longer needs to keep
+func sendStandbyStatus(conn *pgconn.PgConn, received uint64, flushed uint64) error {
+	buf := make([]byte, 34)
+	buf[0] = 'r'
+	binary.BigEndian.PutUint64(buf[1:], received)
+	binary.BigEndian.PutUint64(buf[9:], flushed)
+	binary.BigEndian.PutUint64(buf[17:], flushed)
+	binary.BigEndian.PutUint64(buf[25:], uint64(time.Since(pgEpoch).Nanoseconds()/1000))
+
+	conn.Frontend().Send(&pgproto3.CopyData{Data: buf})
+
+	return conn.Frontend().Flush()
+}
+
+// walWriter assembles the WAL received from the server into segment files and archives each one once complete
+type walWriter struct {
+	app      *app
+	timeline uint64
+	// the segment being written to, and its local (temporary) file
+	segment uint64
+	file    *os.File
+	// true iff the segment has changed since the last time it was uploaded as .partial
+	dirty bool
+	// true iff the segment was uploaded as .partial at least once
+	partialUploaded bool
+	// end of the WAL received so far, and of the WAL archived so far
+	received uint64
+	flushed  uint64
+}
+
+// write data, which starts at the LSN start, to the segment files; returns true iff at least one segment was
+// completed and archived
+func (w *walWriter) write(start uint64, data []byte) (bool, error) {
+	size := w.app.walSegmentSize
+	completed := false
+	for len(data) > 0 {
+		segment := start / size
+		if w.file == nil || segment != w.segment {
+			if err := w.open(segment); err != nil {
+				return completed, err
+			}
+		}
+
+		offset := start % size
+		n := uint64(len(data))
+		if offset+n > size {
+			n = size - offset
+		}
+		if _, err := w.file.WriteAt(data[:n], int64(offset)); err != nil {
+			return completed, err
+		}
+		w.dirty = true
+		start += n
+		data = data[n:]
+		w.received = start
+
+		if start%size == 0 {
+			if err := w.complete(); err != nil {
+				return completed, err
+			}
+			w.flushed = start
+			completed = true
+		}
+	}
+
+	return completed, nil
+}
+
+func (w *walWriter) name() string {
+	return walSegmentName(w.timeline, w.segment, w.app.walSegmentSize)
+}
+
+// start writing to a new segment
+func (w *walWriter) open(segment uint64) error {
+	w.discard()
+
+	w.segment = segment
+	f, err := ioutil.TempFile(*w.app.tmpDirectory, "pgCarpenter."+w.name()+".")
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.dirty = false
+	w.partialUploaded = false
+
+	return nil
+}
+
+// archive the complete segment and remove any partial version of it
+func (w *walWriter) complete() error {
+	name := w.name()
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := w.app.putWAL(name, w.file.Name()); err != nil {
+		return err
+	}
+	w.app.logger.Info("Archived WAL segment", zap.String("segment", name))
+
+	if w.partialUploaded {
+		if err := w.app.storage.Delete(w.app.ctx, w.app.getWALObjectKey(name+".partial")); err != nil {
+			w.app.logger.Error("Failed to delete partial WAL segment", zap.String("segment", name), zap.Error(err))
+		}
+	}
+
+	util.MustRemoveFile(w.file.Name(), w.app.logger)
+	w.file = nil
+
+	return nil
+}
+
+// upload the segment being written to as <segment>.partial, if it changed since the last time
+func (w *walWriter) uploadPartial() error {
+	if w.file == nil || !w.dirty {
+		return nil
+	}
+
+	name := w.name() + ".partial"
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	if err := w.app.putWAL(name, w.file.Name()); err != nil {
+		return err
+	}
+	w.app.logger.Debug("Uploaded partial WAL segment", zap.String("segment", name))
+	w.dirty = false
+	w.partialUploaded = true
+
+	return nil
+}
+
+// remove the local file of the segment being written to, if any
+func (w *walWriter) discard() {
+	if w.file == nil {
+		return
+	}
+
+	w.file.Close()
+	util.MustRemoveFile(w.file.Name(), w.app.logger)
+	w.file = nil
+}
+
+// formatLSN is the inverse of parseLSN
+func formatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", lsn>>32, uint32(lsn))
+}
+
+// parseSize converts a PG memory size (e.g., 16MB) into bytes
+func parseSize(size string) (uint64, error) {
+	units := []struct {
+		suffix     string
+		multiplier uint64
+	}{
+		{"GB", 1024 * 1024 * 1024},
+		{"MB", 1024 * 1024},
+		{"kB", 1024},
+		{"B", 1},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(size, u.suffix) {
+			n, err := strconv.ParseUint(strings.TrimSuffix(size, u.suffix), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			if n > math.MaxUint64/u.multiplier {
+				return 0, errors.New("size out of range: " + size)
+			}
+			return n * u.multiplier, nil
+		}
+	}
+
+	return strconv.ParseUint(size, 10, 64)
+}
+
+func validateSlotName(args []string) error {
+	if !slotNameRE.MatchString(args[0]) {
+		return fmt.Errorf("replication slot name ('%s') does not match '%s'", args[0], slotNameRE)
+	}
+
+	return nil
+}
+
+func parseStreamWALArgs(cfg *app, parser *argparse.Command) {
+	cfg.slotName = parser.String(
+		"",
+		"slot",
+		&argparse.Options{
+			Required: false,
+			Validate: validateSlotName,
+			Default:  cfg.config.stringValue("slot", "pgcarpenter"),
+			Help:     "Physical replication slot to stream WAL from"})
+	cfg.createSlot = cfg.config.flag(
+		parser,
+		"create-slot",
+		"Create the replication slot if it does not exist")
+	cfg.statusInterval = parser.Int(
+		"",
+		"status-interval",
+		&argparse.Options{
+			Required: false,
+			Default:  cfg.config.intValue("status-interval", 10),
+			Help:     "Number of seconds between status updates sent to the server"})
+	cfg.partialInterval = parser.Int(
+		"",
+		"partial-interval",
+		&argparse.Options{
+			Required: false,
+			Default:  cfg.config.intValue("partial-interval", 60),
+			Help:     "Number of seconds between uploads of the WAL segment being written to (as .partial)"})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pierrec/lz4"
+	"go.uber.org/zap"
+)
+
+// return the decompressed contents of the archived WAL file name, or nil if there's no such file
+func (s *memoryStorage) wal(t *testing.T, name string) []byte {
+	body, err := s.GetString(context.Background(), walFolder+"/"+name+lz4.Extension)
+	if err != nil {
+		return nil
+	}
+	contents, err := ioutil.ReadAll(lz4.NewReader(strings.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return contents
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size     string
+		expected uint64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"100B", 100},
+		{"8kB", 8 * 1024},
+		{"16MB", 16 * 1024 * 1024},
+		{"1GB", 1024 * 1024 * 1024},
+	}
+	for _, test := range tests {
+		size, err := parseSize(test.size)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.size, err)
+			continue
+		}
+		if size != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.size, test.expected, size)
+		}
+	}
+
+	for _, size := range []string{"", "MB", "16mb", "16 MB", "-1MB", "1.5GB", "1TB", "99999999999999GB"} {
+		if _, err := parseSize(size); err == nil {
+			t.Errorf("%q: expected an error", size)
+		}
+	}
+}
+
+func TestValidateSlotName(t *testing.T) {
+	for _, name := range []string{"pgcarpenter", "slot_1", strings.Repeat("a", 63)} {
+		if err := validateSlotName([]string{name}); err != nil {
+			t.Errorf("%q: unexpected error: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "Slot", "a-b", "a b", "x; DROP", strings.Repeat("a", 64)} {
+		if err := validateSlotName([]string{name}); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+}
+
+// walWriterApp returns an app archiving WAL segments of 16 bytes to memory
+func walWriterApp(t *testing.T) (*app, *memoryStorage) {
+	tmp, err := ioutil.TempDir("", "pgCarpenter.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmp) })
+
+	s := newMemoryStorage()
+	a := &app{
+		ctx:      context.Background(),
+		logger:   zap.NewNop(),
+		storage:  s,
+		runState: &runState{walSegmentSize: 16},
+	}
+	a.tmpDirectory = &tmp
+
+	return a, s
+}
+
+func TestWALWriter(t *testing.T) {
+	a, s := walWriterApp(t)
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+
+	// start in the middle of the second segment, as after a restart
+	w := &walWriter{app: a, timeline: 1, received: 24, flushed: 24}
+	defer w.discard()
+
+	// not enough to complete the segment
+	completed, err := w.write(24, data[:4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if completed || w.received != 28 || w.flushed != 24 {
+		t.Errorf("unexpected state after a partial write: %v, %d, %d", completed, w.received, w.flushed)
+	}
+
+	// it's uploaded as .partial, but only when it changed
+	if err := w.uploadPartial(); err != nil {
+		t.Fatal(err)
+	}
+	name := walSegmentName(1, 1, 16)
+	partial := s.wal(t, name+".partial")
+	if !bytes.Equal(partial[8:12], data[:4]) {
+		t.Errorf("unexpected contents of the partial segment: %q", partial)
+	}
+	s.Delete(context.Background(), walFolder+"/"+name+".partial"+lz4.Extension)
+	if err := w.uploadPartial(); err != nil {
+		t.Fatal(err)
+	}
+	if s.wal(t, name+".partial") != nil {
+		t.Error("unchanged partial segment uploaded again")
+	}
+
+	// complete the segment, fill the next one, and start another
+	completed, err = w.write(28, data[4:26])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !completed || w.received != 50 || w.flushed != 48 {
+		t.Errorf("unexpected state after completing segments: %v, %d, %d", completed, w.received, w.flushed)
+	}
+	if segment := s.wal(t, name); !bytes.Equal(segment[8:], data[:8]) {
+		t.Errorf("unexpected contents of segment %s: %q", name, segment)
+	}
+	if s.wal(t, name+".partial") != nil {
+		t.Error("partial segment not deleted once complete")
+	}
+	next := walSegmentName(1, 2, 16)
+	if segment := s.wal(t, next); !bytes.Equal(segment, data[8:24]) {
+		t.Errorf("unexpected contents of segment %s: %q", next, segment)
+	}
+	if s.wal(t, walSegmentName(1, 3, 16)) != nil {
+		t.Error("incomplete segment archived")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/thumbtack/pgCarpenter/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	tablespacesDirectory = "pg_tblspc"
+	tablespaceMapFile    = "tablespace_map"
+)
+
+// isTablespaceLink returns true iff file (relative to the data directory) is the symlink PG creates in
+// pg_tblspc for each user tablespace
+func isTablespaceLink(file string, info os.FileInfo) bool {
+	return filepath.Dir(file) == tablespacesDirectory && info.Mode()&os.ModeSymlink != 0
+}
+
+// parseTablespaceMap parses the contents of a tablespace_map file, i.e., one "<OID> <path>" line per tablespace,
+// into a map of OID to path. Like PG, it takes a backslash to escape the character that follows it, which PG does
+// for line breaks and backslashes in paths.
+func parseTablespaceMap(contents string) (map[string]string, error) {
+	tablespaces := make(map[string]string)
+	parseLine := func(line string) error {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return fmt.Errorf("invalid line in %s: %s", tablespaceMapFile, line)
+		}
+		tablespaces[fields[0]] = fields[1]
+		return nil
+	}
+
+	line := make([]byte, 0)
+	escaped := false
+	for i := 0; i < len(contents); i++ {
+		c := contents[i]
+		switch {
+		case escaped:
+			line = append(line, c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '\n' || c == '\r':
+			// empty lines (e.g., the second half of a \r\n) are ignored
+			if len(line) > 0 {
+				if err := parseLine(string(line)); err != nil {
+					return nil, err
+				}
+				line = line[:0]
+			}
+		default:
+			line = append(line, c)
+		}
+	}
+	// the last line may not be terminated
+	if len(line) > 0 {
+		if err := parseLine(string(line)); err != nil {
+			return nil, err
+		}
+	}
+
+	return tablespaces, nil
+}
+
+// formatTablespaceMap is the inverse of parseTablespaceMap
+func formatTablespaceMap(tablespaces map[string]string) string {
+	oids := make([]string, 0, len(tablespaces))
+	for oid := range tablespaces {
+		oids = append(oids, oid)
+	}
+	sort.Strings(oids)
+
+	escaper := strings.NewReplacer(`\`, `\\`, "\n", "\\\n", "\r", "\\\r")
+	contents := ""
+	for _, oid := range oids {
+		contents += oid + " " + escaper.Replace(tablespaces[oid]) + "\n"
+	}
+
+	return contents
+}
+
+// parseTablespaceRemap parses the values of --tablespace-map (OID=/new/path) into a map of OID to path
+func parseTablespaceRemap(values []string) (map[string]string, error) {
+	remap := make(map[string]string)
+	for _, v := range values {
+		fields := strings.SplitN(v, "=", 2)
+		if len(fields) != 2 || fields[0] == "" || !filepath.IsAbs(fields[1]) {
+			return nil, errors.New("tablespace mapping must be of the form OID=/absolute/path: " + v)
+		}
+		remap[fields[0]] = filepath.Clean(fields[1])
+	}
+
+	return remap, nil
+}
+
+// restoreTablespaces creates the directory of each tablespace listed in the backup's tablespace_map, remapped as
+// requested, and the symlink to it in pg_tblspc, so that restoring pg_tblspc/<OID>/... writes to the right place.
+// It returns the (remapped) tablespaces, or nil if the backup does not include any.
+func (a *app) restoreTablespaces() (map[string]string, error) {
+	remap, err := parseTablespaceRemap(*a.tablespaceMap)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := a.storage.GetString(a.ctx, *a.backupName+"/"+tablespaceMapFile)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		a.logger.Debug("No tablespace map found")
+		if len(remap) > 0 {
+			return nil, errors.New("tablespace mapping requested but the backup does not include any tablespace")
+		}
+		return nil, nil
+	}
+
+	tablespaces, err := parseTablespaceMap(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	for oid, path := range remap {
+		if _, ok := tablespaces[oid]; !ok {
+			return nil, errors.New("tablespace not found in backup: " + oid)
+		}
+		tablespaces[oid] = path
+	}
+
+	if err := os.MkdirAll(filepath.Join(*a.pgDataDirectory, tablespacesDirectory), 0700); err != nil {
+		return nil, err
+	}
+
+	for oid, path := range tablespaces {
+		a.logger.Info("Restoring tablespace", zap.String("oid", oid), zap.String("path", path))
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return nil, err
+		}
+
+		link := filepath.Join(*a.pgDataDirectory, tablespacesDirectory, oid)
+		// replace whatever is there, e.g., a link to the original location from a previous restore
+		if st, err := os.Lstat(link); err == nil {
+			if st.Mode()&os.ModeSymlink == 0 {
+				return nil, errors.New("tablespace path in data directory is not a symlink: " + link)
+			}
+			if err := os.Remove(link); err != nil {
+				return nil, err
+			}
+		}
+		if err := os.Symlink(path, link); err != nil {
+			return nil, err
+		}
+	}
+
+	return tablespaces, nil
+}
+
+// writeTablespaceMap overwrites the tablespace_map restored from the backup with the remapped locations; PG uses it
+// to recreate the links in pg_tblspc when recovery starts
+func (a *app) writeTablespaceMap(tablespaces map[string]string) error {
+	path := filepath.Join(*a.pgDataDirectory, tablespaceMapFile)
+
+	return ioutil.WriteFile(path, []byte(formatTablespaceMap(tablespaces)), 0600)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestParseTablespaceMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		expected map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{"paths", "16384 /mnt/ts1\n16385 /mnt/ts 2\n", map[string]string{"16384": "/mnt/ts1", "16385": "/mnt/ts 2"}},
+		{"no trailing line break", "16384 /mnt/ts1", map[string]string{"16384": "/mnt/ts1"}},
+		{"carriage returns", "16384 /mnt/ts1\r\n16385 /mnt/ts2\r\n", map[string]string{
+			"16384": "/mnt/ts1", "16385": "/mnt/ts2"}},
+		{"escaped", "16384 /mnt/a\\\nb\n16385 /mnt/c\\\\d\\\re\n", map[string]string{
+			"16384": "/mnt/a\nb", "16385": "/mnt/c\\d\re"}},
+	}
+	for _, test := range tests {
+		tablespaces, err := parseTablespaceMap(test.contents)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(tablespaces, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, tablespaces)
+		}
+	}
+
+	for _, contents := range []string{"16384\n", " /mnt/ts1\n"} {
+		if _, err := parseTablespaceMap(contents); err == nil {
+			t.Errorf("%q: expected an error", contents)
+		}
+	}
+}
+
+func TestFormatTablespaceMap(t *testing.T) {
+	tablespaces := map[string]string{"16385": "/mnt/c\\d\re", "16384": "/mnt/a\nb"}
+	contents := formatTablespaceMap(tablespaces)
+	if contents != "16384 /mnt/a\\\nb\n16385 /mnt/c\\\\d\\\re\n" {
+		t.Errorf("unexpected contents: %q", contents)
+	}
+
+	parsed, err := parseTablespaceMap(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, tablespaces) {
+		t.Errorf("expected %q, got %q", tablespaces, parsed)
+	}
+}
+
+func TestParseTablespaceRemap(t *testing.T) {
+	remap, err := parseTablespaceRemap([]string{"16384=/mnt/new/", "16385=/mnt/a=b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"16384": "/mnt/new", "16385": "/mnt/a=b"}
+	if !reflect.DeepEqual(remap, expected) {
+		t.Errorf("expected %v, got %v", expected, remap)
+	}
+
+	for _, v := range []string{"16384", "=/mnt/new", "16384=relative"} {
+		if _, err := parseTablespaceRemap([]string{v}); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
+
+func TestRestoreTablespacesWithoutMap(t *testing.T) {
+	s := newMemoryStorage()
+	name := "backup"
+	remap := []string{}
+	a := &app{ctx: context.Background(), logger: zap.NewNop(), storage: s, runState: &runState{}}
+	a.backupName = &name
+	a.tablespaceMap = &remap
+
+	// a backup without tablespaces
+	tablespaces, err := a.restoreTablespaces()
+	if tablespaces != nil || err != nil {
+		t.Errorf("expected no tablespaces and no error, got %v, %v", tablespaces, err)
+	}
+
+	// failing to read the map is not the same
+	s.failures[name+"/"+tablespaceMapFile] = errors.New("connection reset by peer")
+	if _, err := a.restoreTablespaces(); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,137 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket limiting the rate at which bytes are transferred, shared by everything it's passed to.
+// It allows bursts of up to one second worth of bytes. A nil Limiter does not limit anything.
+type Limiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// New returns a Limiter allowing bytesPerSecond, or nil if bytesPerSecond is not positive.
+func New(bytesPerSecond int64) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &Limiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// Wait blocks until n bytes may be transferred, or ctx is canceled. Transfers larger than what's in the bucket put it
+// in debt, which the caller waits for the bucket to refill.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mutex.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type reader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *Limiter
+}
+
+// NewReader returns a reader that reads from r no faster than limiter allows. If limiter is nil, r is returned.
+func NewReader(ctx context.Context, r io.Reader, limiter *Limiter) io.Reader {
+	if limiter == nil {
+		return r
+	}
+
+	return &reader{ctx: ctx, r: r, limiter: limiter}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if waitErr := r.limiter.Wait(r.ctx, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+
+	return n, err
+}
+
+// ReadSeekerAt is a reader that can also be read at any offset (e.g., concurrently), like an *os.File
+type ReadSeekerAt interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+type readSeekerAt struct {
+	reader
+	at ReadSeekerAt
+}
+
+// NewReadSeekerAt returns a reader like NewReader, which can also seek and read at any offset as r does. If limiter is
+// nil, r is returned.
+func NewReadSeekerAt(ctx context.Context, r ReadSeekerAt, limiter *Limiter) ReadSeekerAt {
+	if limiter == nil {
+		return r
+	}
+
+	return &readSeekerAt{reader: reader{ctx: ctx, r: r, limiter: limiter}, at: r}
+}
+
+func (r *readSeekerAt) Seek(offset int64, whence int) (int64, error) {
+	return r.at.Seek(offset, whence)
+}
+
+func (r *readSeekerAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.at.ReadAt(p, off)
+	if waitErr := r.limiter.Wait(r.ctx, n); waitErr != nil && (err == nil || err == io.EOF) {
+		err = waitErr
+	}
+
+	return n, err
+}
+
+type writerAt struct {
+	ctx     context.Context
+	w       io.WriterAt
+	limiter *Limiter
+}
+
+// NewWriterAt returns a writer that writes to w no faster than limiter allows. If limiter is nil, w is returned.
+func NewWriterAt(ctx context.Context, w io.WriterAt, limiter *Limiter) io.WriterAt {
+	if limiter == nil {
+		return w
+	}
+
+	return &writerAt{ctx: ctx, w: w, limiter: limiter}
+}
+
+func (w *writerAt) WriteAt(p []byte, off int64) (int, error) {
+	if err := w.limiter.Wait(w.ctx, len(p)); err != nil {
+		return 0, err
+	}
+
+	return w.w.WriteAt(p, off)
+}
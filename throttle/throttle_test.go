@@ -0,0 +1,120 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	if New(0) != nil || New(-1) != nil {
+		t.Error("expected no limiter for a rate that is not positive")
+	}
+	if New(1) == nil {
+		t.Error("expected a limiter for a positive rate")
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	if err := l.Wait(context.Background(), 1<<30); err != nil {
+		t.Errorf("expected a nil limiter not to wait, got %v", err)
+	}
+
+	r := bytes.NewReader(nil)
+	if NewReader(context.Background(), r, nil) != io.Reader(r) {
+		t.Error("expected NewReader to return the reader when not limited")
+	}
+	if NewReadSeekerAt(context.Background(), r, nil) != ReadSeekerAt(r) {
+		t.Error("expected NewReadSeekerAt to return the reader when not limited")
+	}
+}
+
+func TestWait(t *testing.T) {
+	l := New(1000)
+
+	// the bucket starts full
+	begin := time.Now()
+	if err := l.Wait(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(begin); elapsed > 100*time.Millisecond {
+		t.Errorf("expected a full bucket not to wait, waited %v", elapsed)
+	}
+
+	// the bucket is now empty
+	begin = time.Now()
+	if err := l.Wait(context.Background(), 300); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(begin); elapsed < 250*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected to wait about 300ms, waited %v", elapsed)
+	}
+
+	// a transfer larger than the bucket waits for its debt to be repaid
+	begin = time.Now()
+	if err := l.Wait(context.Background(), 1500); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(begin); elapsed < 1400*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("expected to wait about 1.5s, waited %v", elapsed)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	l := New(10)
+	if err := l.Wait(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	if err := l.Wait(ctx, 100); err != context.DeadlineExceeded {
+		t.Errorf("expected the wait to be canceled, got %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("expected the wait to stop when canceled, waited %v", elapsed)
+	}
+}
+
+func TestReader(t *testing.T) {
+	data := bytes.Repeat([]byte("pgCarpenter"), 100)
+	l := New(int64(len(data)) / 2)
+
+	begin := time.Now()
+	read, err := ioutil.ReadAll(NewReader(context.Background(), bytes.NewReader(data), l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Error("expected to read the data unchanged")
+	}
+	// half of it comes out of the full bucket, the other half takes a second
+	if elapsed := time.Since(begin); elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("expected reading to take about 1s, took %v", elapsed)
+	}
+}
+
+func TestReadSeekerAt(t *testing.T) {
+	data := []byte("0123456789")
+	r := NewReadSeekerAt(context.Background(), bytes.NewReader(data), New(1<<20))
+
+	p := make([]byte, 4)
+	if n, err := r.ReadAt(p, 3); n != 4 || err != nil || string(p) != "3456" {
+		t.Errorf("expected to read 3456 at offset 3, got %q (%v)", p[:n], err)
+	}
+	if _, err := r.Seek(8, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(r)
+	if err != nil || string(rest) != "89" {
+		t.Errorf("expected to read 89 after seeking, got %q (%v)", rest, err)
+	}
+	if n, err := r.ReadAt(p, 8); n != 2 || err != io.EOF {
+		t.Errorf("expected a short read at the end, got %d bytes (%v)", n, err)
+	}
+}
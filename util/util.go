@@ -2,11 +2,16 @@ package util
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 
 	"github.com/pierrec/lz4"
+	"github.com/thumbtack/pgCarpenter/throttle"
 	"go.uber.org/zap"
 )
 
@@ -35,32 +40,67 @@ func IsObjectDirectory(path string) bool {
 // any intermediate temporary files it might need to create. It returns the full path to the
 // compressed file, or an error.
 func Compress(inPath string, tmpDir string) (string, error) {
+	out, _, err := CompressWithHash(context.Background(), inPath, tmpDir, nil, nil)
+
+	return out, err
+}
+
+// CompressWithHash works like Compress, and also returns the hex encoded SHA-256 digest of the
+// (uncompressed) contents it read from inPath, which is read no faster than limiter allows (if not nil).
+// Everything read is also written to tap, if not nil.
+func CompressWithHash(
+	ctx context.Context,
+	inPath string,
+	tmpDir string,
+	limiter *throttle.Limiter,
+	tap io.Writer) (string, string, error) {
 	// create a temporary file with a unique name compress it -- multiple files
 	// are named 000: pg_notify/0000, pg_subtrans/0000
 	outFile, err := ioutil.TempFile(tmpDir, "pgCarpenter.")
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	// open input file
 	inFile, err := os.Open(inPath)
 	if err != nil {
-		return "", err
+		outFile.Close()
+		os.Remove(outFile.Name())
+		return "", "", err
 	}
 	// we open this for read only, and this process exists after a finite (short)
 	// period of time; there's no need to throw an error if closing it fails
 	defer inFile.Close()
 
-	// buffer read from the input file and lz4 writer
-	r := bufio.NewReader(inFile)
+	// buffer read from the input file, hashing everything read, and lz4 writer
+	h := sha256.New()
+	r := io.TeeReader(bufio.NewReader(throttle.NewReader(ctx, inFile, limiter)), withTap(h, tap))
 	w := lz4.NewWriter(outFile)
 
+	if err := compress(r, w); err != nil {
+		// e.g., interrupted while waiting for the limiter; don't leave the partial output behind
+		outFile.Close()
+		os.Remove(outFile.Name())
+		return "", "", err
+	}
+
+	// make sure we successfully close the compressed file
+	if err := outFile.Close(); err != nil {
+		os.Remove(outFile.Name())
+		return "", "", err
+	}
+
+	return outFile.Name(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copy everything read from r to the lz4 writer w, flushing it at the end
+func compress(r io.Reader, w *lz4.Writer) error {
 	// read 4k at a time
 	buf := make([]byte, 4096)
 	for {
 		n, err := r.Read(buf)
 		if err != nil && err != io.EOF {
-			return "", err
+			return err
 		}
 
 		// we're done
@@ -70,21 +110,110 @@ func Compress(inPath string, tmpDir string) (string, error) {
 
 		// write the 4k chunk
 		if _, err := w.Write(buf[:n]); err != nil {
-			return "", err
+			return err
 		}
 	}
 
 	// flush any pending compressed data
-	if err = w.Flush(); err != nil {
-		return "", err
+	return w.Flush()
+}
+
+// CopyWithHash copies the file inPath to a new temporary file in tmpDir, reading it no faster than limiter allows (if
+// not nil). It returns the full path to the copy and the hex encoded SHA-256 digest of its contents, or an error.
+// Everything read is also written to tap, if not nil.
+func CopyWithHash(
+	ctx context.Context,
+	inPath string,
+	tmpDir string,
+	limiter *throttle.Limiter,
+	tap io.Writer) (string, string, error) {
+	outFile, err := ioutil.TempFile(tmpDir, "pgCarpenter.")
+	if err != nil {
+		return "", "", err
 	}
 
-	// make sure we successfully close the compressed file
+	inFile, err := os.Open(inPath)
+	if err != nil {
+		outFile.Close()
+		os.Remove(outFile.Name())
+		return "", "", err
+	}
+	// we open this for read only; there's no need to throw an error if closing it fails
+	defer inFile.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(outFile, withTap(h, tap)), throttle.NewReader(ctx, inFile, limiter)); err != nil {
+		outFile.Close()
+		os.Remove(outFile.Name())
+		return "", "", err
+	}
+
+	// make sure we successfully close the copy
 	if err := outFile.Close(); err != nil {
+		os.Remove(outFile.Name())
+		return "", "", err
+	}
+
+	return outFile.Name(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// HashReader reads from another reader, keeping track of the SHA-256 digest and the number of bytes of what it read.
+type HashReader struct {
+	r    io.Reader
+	h    hash.Hash
+	tap  io.Writer
+	size int64
+}
+
+// NewHashReader returns a HashReader that reads from r. Everything read is also written to tap, if not nil.
+func NewHashReader(r io.Reader, tap io.Writer) *HashReader {
+	h := sha256.New()
+
+	return &HashReader{r: r, h: h, tap: withTap(h, tap)}
+}
+
+func (r *HashReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.tap.Write(p[:n])
+	r.size += int64(n)
+
+	return n, err
+}
+
+// Sum returns the hex encoded SHA-256 digest of everything read so far.
+func (r *HashReader) Sum() string {
+	return hex.EncodeToString(r.h.Sum(nil))
+}
+
+// Size returns the number of bytes read so far.
+func (r *HashReader) Size() int64 {
+	return r.size
+}
+
+// return a writer to both w and tap, or just w if tap is nil
+func withTap(w io.Writer, tap io.Writer) io.Writer {
+	if tap == nil {
+		return w
+	}
+
+	return io.MultiWriter(w, tap)
+}
+
+// HashFile returns the hex encoded SHA-256 digest of the contents of the file path.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	// we open this for read only; there's no need to throw an error if closing it fails
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
 		return "", err
 	}
 
-	return outFile.Name(), nil
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // Decompress decompresses the file inPath to outPath.
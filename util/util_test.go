@@ -0,0 +1,98 @@
+package util
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thumbtack/pgCarpenter/throttle"
+)
+
+// write a file of size bytes to dir, returning its path
+func writeFile(t *testing.T, dir string, size int) string {
+	path := filepath.Join(dir, "input")
+	if err := ioutil.WriteFile(path, make([]byte, size), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestWithHashInterrupted(t *testing.T) {
+	for name, withHash := range map[string]func(context.Context, string, string, *throttle.Limiter) error{
+		"CompressWithHash": func(ctx context.Context, in string, tmp string, l *throttle.Limiter) error {
+			_, _, err := CompressWithHash(ctx, in, tmp, l, nil)
+			return err
+		},
+		"CopyWithHash": func(ctx context.Context, in string, tmp string, l *throttle.Limiter) error {
+			_, _, err := CopyWithHash(ctx, in, tmp, l, nil)
+			return err
+		},
+	} {
+		dir, err := ioutil.TempDir("", "pgCarpenter.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		in := writeFile(t, dir, 64*1024)
+		tmp := filepath.Join(dir, "tmp")
+		if err := os.Mkdir(tmp, 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		// reading the file takes way longer than the context lasts
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := withHash(ctx, in, tmp, throttle.New(1)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+
+		files, err := ioutil.ReadDir(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) > 0 {
+			t.Errorf("%s: temporary file left behind: %s", name, files[0].Name())
+		}
+	}
+}
+
+func TestWithHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgCarpenter.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in := writeFile(t, dir, 10000)
+	expected, err := HashFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, hash, err := CompressWithHash(context.Background(), in, dir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out)
+	if hash != expected {
+		t.Errorf("CompressWithHash: expected hash %s, got %s", expected, hash)
+	}
+	decompressed := filepath.Join(dir, "decompressed")
+	if err := Decompress(out, decompressed); err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := HashFile(decompressed); hash != expected {
+		t.Errorf("CompressWithHash: the decompressed file does not match the input")
+	}
+
+	out, hash, err = CopyWithHash(context.Background(), in, dir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out)
+	if copied, _ := HashFile(out); hash != expected || copied != expected {
+		t.Errorf("CopyWithHash: expected hash %s, got %s (copy: %s)", expected, hash, copied)
+	}
+}